@@ -0,0 +1,104 @@
+// Package blobstore stores the archived packfiles, on Google Cloud Storage,
+// an S3-compatible service or the local filesystem.
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+// ErrNotExist is returned when a blob is not there.
+var ErrNotExist = errors.New("blob doesn't exist")
+
+// Store is a flat namespace of immutable blobs. Names can contain slashes.
+type Store interface {
+	// NewWriter returns a Writer storing the blob name. The blob is only
+	// there once the Writer is closed without error.
+	NewWriter(ctx context.Context, name string) Writer
+
+	// NewRangeReader reads at most length bytes of the blob name from
+	// offset, or until the end if length is negative.
+	NewRangeReader(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+
+	// Stat returns the attributes of the blob name.
+	Stat(ctx context.Context, name string) (*Attrs, error)
+
+	// List calls f with the blobs whose names start with prefix, in
+	// order, and stops at the first error f returns.
+	List(ctx context.Context, prefix string, f func(*Attrs) error) error
+
+	// Delete removes the blob name.
+	Delete(ctx context.Context, name string) error
+}
+
+// Writer stores a blob as it's written.
+type Writer interface {
+	io.Writer
+
+	// Close finishes storing the blob and reports any error.
+	Close() error
+
+	// CloseWithError aborts the upload, leaving the blob as it was.
+	CloseWithError(err error) error
+}
+
+// Attrs are the attributes of a blob.
+type Attrs struct {
+	Name    string
+	Size    int64
+	Updated time.Time
+}
+
+// NewReader reads the whole blob name from s.
+func NewReader(ctx context.Context, s Store, name string) (io.ReadCloser, error) {
+	return s.NewRangeReader(ctx, name, 0, -1)
+}
+
+// Open returns the Store at rawurl, which is one of:
+//
+//	gs://BUCKET                         a Google Cloud Storage bucket
+//	s3://BUCKET?endpoint=URL&region=R   a bucket of an S3-compatible service
+//	file:///PATH or /PATH               a local directory
+//
+// The credentials for GCS come from the environment, as usual. Those for S3
+// are AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. The S3 endpoint defaults
+// to AWS, and the region to us-east-1.
+func Open(ctx context.Context, rawurl string) (Store, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "gs":
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return NewGCS(client.Bucket(u.Host)), nil
+	case "s3":
+		q := u.Query()
+		endpoint := q.Get("endpoint")
+		if endpoint == "" {
+			endpoint = "https://s3.amazonaws.com"
+		}
+		region := q.Get("region")
+		if region == "" {
+			region = "us-east-1"
+		}
+		return NewS3(endpoint, region, u.Host,
+			os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")), nil
+	case "file", "":
+		if u.Path == "" {
+			return nil, fmt.Errorf("missing path in %q", rawurl)
+		}
+		return NewLocal(u.Path)
+	}
+	return nil, fmt.Errorf("unknown blob store %q", rawurl)
+}
@@ -0,0 +1,77 @@
+package blobstore
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+// GCS is a Store on a Google Cloud Storage bucket.
+type GCS struct {
+	bucket *storage.BucketHandle
+}
+
+func NewGCS(bucket *storage.BucketHandle) *GCS {
+	return &GCS{bucket: bucket}
+}
+
+func (s *GCS) NewWriter(ctx context.Context, name string) Writer {
+	return s.bucket.Object(name).NewWriter(ctx)
+}
+
+func (s *GCS) NewRangeReader(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		// GCS would make it a HEAD request, without a body.
+		if _, err := s.Stat(ctx, name); err != nil {
+			return nil, err
+		}
+		return emptyReader{}, nil
+	}
+	r, err := s.bucket.Object(name).NewRangeReader(ctx, offset, length)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNotExist
+	}
+	return r, err
+}
+
+func (s *GCS) Stat(ctx context.Context, name string) (*Attrs, error) {
+	attrs, err := s.bucket.Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Attrs{Name: attrs.Name, Size: attrs.Size, Updated: attrs.Updated}, nil
+}
+
+func (s *GCS) List(ctx context.Context, prefix string, f func(*Attrs) error) error {
+	q := &storage.Query{Prefix: prefix}
+	for q != nil {
+		list, err := s.bucket.List(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, attrs := range list.Results {
+			if err := f(&Attrs{Name: attrs.Name, Size: attrs.Size, Updated: attrs.Updated}); err != nil {
+				return err
+			}
+		}
+		q = list.Next
+	}
+	return nil
+}
+
+func (s *GCS) Delete(ctx context.Context, name string) error {
+	err := s.bucket.Object(name).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return ErrNotExist
+	}
+	return err
+}
+
+type emptyReader struct{}
+
+func (emptyReader) Read(p []byte) (int, error) { return 0, io.EOF }
+func (emptyReader) Close() error               { return nil }
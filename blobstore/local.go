@@ -0,0 +1,153 @@
+package blobstore
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Local is a Store in a local directory, where each blob is a file. Blobs
+// are written to temporary files, which are renamed when complete.
+type Local struct {
+	dir string
+}
+
+// tempPrefix starts the names of the temporary files, which List skips.
+const tempPrefix = ".tmp-"
+
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Local{dir: dir}, nil
+}
+
+func (s *Local) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *Local) NewWriter(ctx context.Context, name string) Writer {
+	w := &localWriter{path: s.path(name)}
+	if w.err = os.MkdirAll(filepath.Dir(w.path), 0755); w.err == nil {
+		w.f, w.err = ioutil.TempFile(filepath.Dir(w.path), tempPrefix)
+	}
+	return w
+}
+
+type localWriter struct {
+	path string
+	f    *os.File
+	err  error
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.f.Write(p)
+	w.err = err
+	return n, err
+}
+
+func (w *localWriter) Close() error {
+	if w.f == nil {
+		return w.err
+	}
+	if err := w.f.Close(); w.err == nil {
+		w.err = err
+	}
+	if w.err == nil {
+		w.err = os.Rename(w.f.Name(), w.path)
+	}
+	if w.err != nil {
+		os.Remove(w.f.Name())
+	}
+	w.f = nil
+	return w.err
+}
+
+func (w *localWriter) CloseWithError(err error) error {
+	if w.err == nil {
+		w.err = err
+	}
+	w.Close()
+	return nil
+}
+
+func (s *Local) NewRangeReader(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+func (s *Local) Stat(ctx context.Context, name string) (*Attrs, error) {
+	fi, err := os.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Attrs{Name: name, Size: fi.Size(), Updated: fi.ModTime()}, nil
+}
+
+func (s *Local) List(ctx context.Context, prefix string, f func(*Attrs) error) error {
+	var res []*Attrs
+	err := filepath.Walk(s.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			res = append(res, &Attrs{Name: name, Size: fi.Size(), Updated: fi.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Walk goes in lexical order of the files of each directory, which
+	// isn't the order of the names.
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	for _, attrs := range res {
+		if err := f(attrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Local) Delete(ctx context.Context, name string) error {
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	return err
+}
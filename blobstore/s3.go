@@ -0,0 +1,323 @@
+package blobstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// S3 is a Store on a bucket of Amazon S3 or of a compatible service, like
+// MinIO. It uses path-style requests, signed with AWS Signature Version 4.
+//
+// Blobs are uploaded in a single request once they are complete, so they
+// are limited to the 5GB S3 allows for those.
+type S3 struct {
+	endpoint, region, bucket string
+	accessKey, secretKey     string
+
+	// Client is the HTTP client for the requests.
+	Client *http.Client
+}
+
+// NewS3 returns a Store on bucket, at endpoint, like
+// "https://s3.amazonaws.com" or "http://localhost:9000".
+func NewS3(endpoint, region, bucket, accessKey, secretKey string) *S3 {
+	return &S3{endpoint: strings.TrimSuffix(endpoint, "/"), region: region, bucket: bucket,
+		accessKey: accessKey, secretKey: secretKey, Client: http.DefaultClient}
+}
+
+// emptyHash is the SHA-256 of the empty payload of most requests.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3) url(name string, query url.Values) string {
+	u := s.endpoint + "/" + awsEscape(s.bucket, true)
+	if name != "" {
+		u += "/" + awsEscape(name, false)
+	}
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	return u
+}
+
+// do signs and sends a request, and turns the errors of S3 into Go errors.
+func (s *S3) do(ctx context.Context, req *http.Request, payloadHash string) (*http.Response, error) {
+	signV4(req, payloadHash, s.region, s.accessKey, s.secretKey, time.Now())
+	res, err := ctxhttp.Do(ctx, s.Client, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrNotExist
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", req.Method, req.URL.Path, res.Status, body)
+	}
+	return res, nil
+}
+
+func (s *S3) NewWriter(ctx context.Context, name string) Writer {
+	w := &s3Writer{ctx: ctx, s: s, name: name, h: sha256.New()}
+	w.f, w.err = ioutil.TempFile("", "blobstore")
+	return w
+}
+
+// s3Writer spools the blob to a temporary file, since the request needs
+// its length and its hash.
+type s3Writer struct {
+	ctx  context.Context
+	s    *S3
+	name string
+
+	f    *os.File
+	h    hash.Hash
+	size int64
+	err  error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.f.Write(p)
+	w.h.Write(p[:n])
+	w.size += int64(n)
+	w.err = err
+	return n, err
+}
+
+func (w *s3Writer) Close() error {
+	if w.f == nil {
+		return w.err
+	}
+	defer func() {
+		w.f.Close()
+		os.Remove(w.f.Name())
+		w.f = nil
+	}()
+	if w.err != nil {
+		return w.err
+	}
+	req, err := http.NewRequest("PUT", w.s.url(w.name, nil), io.NewSectionReader(w.f, 0, w.size))
+	if err != nil {
+		w.err = err
+		return err
+	}
+	req.ContentLength = w.size
+	res, err := w.s.do(w.ctx, req, hex.EncodeToString(w.h.Sum(nil)))
+	if err != nil {
+		w.err = err
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (w *s3Writer) CloseWithError(err error) error {
+	if w.err == nil {
+		w.err = err
+	}
+	w.Close()
+	return nil
+}
+
+func (s *S3) NewRangeReader(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		if _, err := s.Stat(ctx, name); err != nil {
+			return nil, err
+		}
+		return emptyReader{}, nil
+	}
+	req, err := http.NewRequest("GET", s.url(name, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	if length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := s.do(ctx, req, emptyHash)
+	if err != nil {
+		return nil, err
+	}
+	if req.Header.Get("Range") != "" && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, fmt.Errorf("s3: range of %s not satisfied", name)
+	}
+	return res.Body, nil
+}
+
+func (s *S3) Stat(ctx context.Context, name string) (*Attrs, error) {
+	req, err := http.NewRequest("HEAD", s.url(name, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(ctx, req, emptyHash)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	updated, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &Attrs{Name: name, Size: res.ContentLength, Updated: updated}, nil
+}
+
+// listResult is the response of ListObjectsV2.
+type listResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3) List(ctx context.Context, prefix string, f func(*Attrs) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		req, err := http.NewRequest("GET", s.url("", query), nil)
+		if err != nil {
+			return err
+		}
+		res, err := s.do(ctx, req, emptyHash)
+		if err != nil {
+			return err
+		}
+		var list listResult
+		err = xml.NewDecoder(res.Body).Decode(&list)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3: listing %s: %v", prefix, err)
+		}
+		for _, c := range list.Contents {
+			if err := f(&Attrs{Name: c.Key, Size: c.Size, Updated: c.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !list.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+}
+
+// Delete removes the blob name. S3 doesn't tell if there was one, so it
+// never returns ErrNotExist.
+func (s *S3) Delete(ctx context.Context, name string) error {
+	req, err := http.NewRequest("DELETE", s.url(name, nil), nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(ctx, req, emptyHash)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+
+// signV4 adds the date, payload hash and authorization headers to req, with
+// all its headers signed.
+func signV4(req *http.Request, payloadHash, region, accessKey, secretKey string, now time.Time) {
+	date := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Make sure the path is sent encoded as it's signed.
+	path := awsEscape(req.URL.Path, false)
+	if path == "" {
+		path = "/"
+	}
+	req.URL.RawPath = path
+	canonicalRequest := strings.Join([]string{req.Method, path, canonicalQuery(req.URL.Query()),
+		canonicalHeaders, signedHeaders, payloadHash}, "\n")
+
+	scope := date[:8] + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hexSHA256(canonicalRequest)
+	key := hmacSHA256([]byte("AWS4"+secretKey), date[:8])
+	for _, s := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+// canonicalQuery encodes query sorted by key, as AWS wants it.
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		for _, v := range values {
+			params = append(params, awsEscape(key, true)+"="+awsEscape(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, and
+// the slashes unless encodeSlash is set.
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -1,69 +1,211 @@
 package main
 
 import (
-	"errors"
+	"bytes"
 	"expvar"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/signal"
+	"regexp"
 	"strings"
-	"sync/atomic"
-	"syscall"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
-	"google.golang.org/cloud/storage"
 
 	"github.com/thecodearchive/gitarchive/git"
 	"github.com/thecodearchive/gitarchive/index"
+	"github.com/thecodearchive/gitarchive/packstore"
 	"github.com/thecodearchive/gitarchive/queue"
 	"github.com/thecodearchive/gitarchive/weekmap"
 )
 
 var maxSize = MustGetenvInt("MAX_REPO_SIZE")
+var protocolVersion = OptGetenvInt("GIT_PROTOCOL_VERSION", 2)
+
+// remoteURL is where repositories are fetched from, with %s replaced by
+// their name, like "github.com/user/repo". It can point to local mirrors,
+// like "/srv/mirrors/%s.git", or to any URL git.Fetch supports.
+var remoteURL = OptGetenv("REMOTE_URL", "git://%s.git")
+
+// tooBigFallbacks are the ways to retry a repository over maxSize before
+// blacklisting it, in order, and each on top of the previous ones:
+// "filter" leaves out the blobs over filterBlobLimit, and "shallow" fetches
+// only shallowDepth commits. Set it to "none" to blacklist right away.
+var tooBigFallbacks = strings.Split(OptGetenv("TOO_BIG_FALLBACKS", "filter,shallow"), ",")
+var filterBlobLimit = OptGetenv("FILTER_BLOB_LIMIT", "1m")
+var shallowDepth = OptGetenvInt("SHALLOW_DEPTH", 1)
+
+// maxResumes is the number of times an interrupted fetch is resumed right
+// away from the complete commits it got. After that, the repository is
+// put back in the queue.
+var maxResumes = OptGetenvInt("MAX_RESUMES", 3)
 
 type Fetcher struct {
 	q        *queue.Queue
 	i        *index.Index
-	bucket   *storage.BucketHandle
+	store    *packstore.Store
 	schedule *weekmap.WeekMap
 
 	exp *expvar.Map
 
-	closing uint32
+	// Timeouts of each git fetch. See git.Options.
+	connectTimeout, idleTimeout, fetchTimeout time.Duration
+
+	// retryBackoff is the delay before retrying a fetch that failed with a
+	// transient error, doubled at each attempt up to maxBackoff.
+	retryBackoff, maxBackoff time.Duration
+
+	// leaseTime is how long the queue waits for news of a fetch, before
+	// giving the repository to another worker.
+	leaseTime time.Duration
+
+	// workers is the number of fetches Run makes at once, which share the
+	// bandwidth, if not nil.
+	workers   int
+	bandwidth *bandwidthLimiter
+
+	// locks keeps the workers off the repositories another one is
+	// fetching, and their parents.
+	locks repoLocks
+
+	// stopping is closed by Stop, for the workers to finish the fetches in
+	// progress. ctx is canceled drainTimeout later, to abort them.
+	stopping     chan struct{}
+	stopOnce     sync.Once
+	drainTimeout time.Duration
+	ctx          context.Context
+	cancel       context.CancelFunc
 }
 
+// Run starts the workers, and returns when they are all done, either
+// because of Stop or of the first error.
 func (f *Fetcher) Run() error {
 	f.exp.Set("fetchbytes", &expvar.Int{})
-	for atomic.LoadUint32(&f.closing) == 0 {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for n := 0; n < f.workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f.work(); err != nil {
+				once.Do(func() { firstErr = err })
+				f.Stop()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// work fetches the repositories of the queue until Stop.
+func (f *Fetcher) work() error {
+	for !f.stopped() {
 		if !f.schedule.Get(time.Now()) {
 			f.exp.Add("sleep", 1)
-			interruptableSleep(5 * time.Minute)
+			f.sleep(5 * time.Minute)
 			continue
 		}
 
-		name, parent, err := f.q.Pop()
+		l, err := f.q.Pop(f.leaseTime)
 		if err != nil {
 			return err
 		}
 
-		if name == "" {
+		if l == nil {
 			f.exp.Add("emptyqueue", 1)
-			interruptableSleep(30 * time.Second)
+			f.sleep(30 * time.Second)
 			continue
 		}
 
-		name = "github.com/" + name
-		if err := f.Fetch(name, parent); err != nil {
-			f.i.AddBlacklist(name, err.Error())
+		if !f.locks.tryLock(l.Name, l.Parent) {
+			// Another worker is on it, or on its parent.
+			f.exp.Add("busy", 1)
+			if err := leaseErr(f.q.Nack(l, busyDelay)); err != nil {
+				return err
+			}
+			continue
+		}
+		done := make(chan struct{})
+		go f.keepLease(l, done)
+		err = f.Fetch("github.com/"+l.Name, l.Parent)
+		close(done)
+		f.locks.unlock(l.Name, l.Parent)
+		if err == nil {
+			if err := f.i.ClearFailure("github.com/" + l.Name); err != nil {
+				return err
+			}
+			if err := leaseErr(f.q.Ack(l)); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.stopped() {
+			// The fetch was interrupted by Stop, put it back for later.
+			log.Println("[-] Fetch interrupted:", err)
+			return leaseErr(f.q.Nack(l, 0))
+		}
+		if err := f.fail(l, err); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// busyDelay is how long a repository waits in the queue when another
+// worker is fetching it or its parent.
+const busyDelay = time.Minute
+
+// keepLease extends l until done is closed, so that the fetch can take
+// longer than leaseTime. If the fetcher dies, the lease expires, and the
+// repository is popped again.
+func (f *Fetcher) keepLease(l *queue.Lease, done chan struct{}) {
+	t := time.NewTicker(f.leaseTime / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			err := f.q.ExtendLease(l, f.leaseTime)
+			if err == queue.ErrLeaseLost {
+				log.Printf("[-] Lost the lease of %s.", l.Name)
+				f.exp.Add("leaselost", 1)
+				return
+			}
+			if err != nil {
+				log.Println("[-] Failed to extend the lease:", err)
+			}
+		}
+	}
+}
+
+// leaseErr ignores queue.ErrLeaseLost, since then another worker got the
+// repository, or will.
+func leaseErr(err error) error {
+	if err == queue.ErrLeaseLost {
+		log.Println("[-] The lease was lost, leaving the repository to the next one.")
+		return nil
+	}
+	return err
+}
+
+// errTooBig is returned by fetch when the packfile exceeds maxSize.
+var errTooBig = policyError{"toobig", "Too big."}
+
+// partialError is returned by fetch when the transfer was interrupted, but
+// the complete commits received were archived to resume from.
+type partialError struct {
+	err error
+}
+
+func (e partialError) Error() string {
+	return "partial fetch: " + e.err.Error()
+}
+
 func (f *Fetcher) Fetch(name, parent string) error {
 	f.exp.Add("fetches", 1)
 
@@ -77,10 +219,20 @@ func (f *Fetcher) Fetch(name, parent string) error {
 		return nil
 	}
 
-	haves, deps, err := f.i.GetHaves(name)
+	haves, shallow, deps, err := f.i.GetHaves(name)
+	if err != nil {
+		return err
+	}
+
+	refFilter := git.DefaultRefFilter
+	include, exclude, ok, err := f.i.GetRefFilter(name)
 	if err != nil {
 		return err
 	}
+	if ok {
+		refFilter = &git.RefFilter{Include: include, Exclude: exclude}
+		f.exp.Add("reffilter", 1)
+	}
 
 	if haves == nil {
 		f.exp.Add("new", 1)
@@ -98,75 +250,440 @@ func (f *Fetcher) Fetch(name, parent string) error {
 	}
 	log.Printf("[+] %s %s%s...", logVerb, name, logFork)
 
-	start := time.Now()
-	bw := f.exp.Get("fetchbytes").(*expvar.Int)
-	refs, packR, err := git.Fetch("git://"+name+".git", haves, os.Stderr, bw)
-	if err, ok := err.(git.RemoteError); ok {
-		if strings.Contains(err.Message, "Repository not found.") {
-			log.Println("[-] Repository vanished :(")
-			f.exp.Add("vanished", 1)
-			return nil
+	opts := &git.Options{
+		BWCounter: f.exp.Get("fetchbytes").(*expvar.Int), ProtocolVersion: protocolVersion, Shallows: shallow, RefFilter: refFilter,
+		HaveDates:      f.haveDates(haves, deps),
+		ConnectTimeout: f.connectTimeout, IdleTimeout: f.idleTimeout, Timeout: f.fetchTimeout,
+	}
+	limit := blacklistState != index.Whitelisted
+	err = f.fetchResuming(name, parent, haves, deps, opts, limit)
+
+	// Better an incomplete archive than nothing.
+	for _, fallback := range tooBigFallbacks {
+		if err != errTooBig {
+			break
+		}
+		previous := *opts
+		switch fallback {
+		case "filter":
+			opts.Filter = "blob:limit=" + filterBlobLimit
+			log.Printf("[-] Repository too big, retrying without blobs over %s...", filterBlobLimit)
+		case "shallow":
+			opts.Depth = shallowDepth
+			log.Printf("[-] Repository too big, retrying with depth %d...", shallowDepth)
+		default:
+			continue
+		}
+		f.exp.Add(fallback+"retry", 1)
+		err = f.fetchResuming(name, parent, haves, deps, opts, limit)
+		if _, ok := err.(git.UnsupportedError); ok {
+			log.Println("[-] Can't retry:", err)
+			*opts = previous
+			err = errTooBig
 		}
-		if strings.Contains(err.Message, "DMCA") {
-			log.Println("[-] Repository DMCA'd :(")
-			f.exp.Add("dmca", 1)
-			return nil
+	}
+	return err
+}
+
+// fetchResuming calls fetch, resuming it up to maxResumes times from the
+// latest partial fetch when it's interrupted.
+func (f *Fetcher) fetchResuming(name, parent string, haves map[string]struct{},
+	deps []string, opts *git.Options, limit bool) error {
+
+	for resumes := 0; ; resumes++ {
+		err := f.fetch(name, parent, haves, deps, opts, limit)
+		if _, ok := err.(partialError); !ok || resumes >= maxResumes {
+			return err
 		}
+		haves, opts.Shallows, deps, err = f.i.GetHaves(name)
+		if err != nil {
+			return err
+		}
+		opts.HaveDates = f.haveDates(haves, deps)
+		f.exp.Add("resumes", 1)
+		log.Printf("[-] Resuming with %d haves...", len(haves))
 	}
+}
+
+// fetch fetches and archives a repository with opts. If limit is set, it
+// gives up with errTooBig after maxSize bytes. If the transfer is
+// interrupted, it archives what it can and returns a partialError.
+func (f *Fetcher) fetch(name, parent string, haves map[string]struct{},
+	deps []string, opts *git.Options, limit bool) error {
+
+	start := time.Now()
+	// Each worker has a fetch in flight, so they are keyed by repository.
+	inflight := new(expvar.Map).Init()
+	f.exp.Set("inflight/"+name, inflight)
+	defer f.exp.Delete("inflight/" + name)
+	o := *opts
+	o.Progress = func(p git.Progress) { f.progress(inflight, p) }
+	o.MsgW = &messageLog{}
+	res, err := git.FetchContext(f.ctx, fmt.Sprintf(remoteURL, name), haves, &o)
 	if err != nil {
 		return err
 	}
+	if res.ProtocolVersion == 2 {
+		f.exp.Add("protocolv2", 1)
+	}
+	f.exp.Add("havessent", int64(res.HavesSent))
+	refs, packR := res.Refs, res.Pack
 
-	packRefName := fmt.Sprintf("%s/%d", name, time.Now().UnixNano())
+	var packRefName string
+	var packSize int64
 	if packR != nil {
-		w := f.bucket.Object(packRefName).NewWriter(context.Background())
+		// Check the packfile as it streams by, so that we don't archive a
+		// truncated or corrupted one.
+		v := git.NewPackVerifier(f.bandwidth.reader(f.ctx, packR))
+		defer v.Close()
+
+		// Keep a local copy to store it under its checksum, and index it,
+		// once it's complete.
+		tmp, err := ioutil.TempFile("", "fetcher")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
 
-		var r io.Reader = packR
-		if blacklistState != index.Whitelisted {
+		var r io.Reader = v
+		if limit {
 			r = &io.LimitedReader{R: r, N: int64(maxSize)}
 		}
-		bytesFetched, err := io.Copy(w, r)
+		bytesFetched, err := io.Copy(tmp, r)
+		packR.Close()
 		if err != nil {
+			if _, ok := err.(git.PackFormatError); ok {
+				return err
+			}
+			if f.ctx.Err() != nil {
+				// Stopping, there's no time to salvage anything.
+				return err
+			}
+			log.Printf("[-] Fetch interrupted after %d bytes: %v", bytesFetched, err)
+			tips, serr := f.salvage(name, parent, haves, deps, opts, res, tmp, bytesFetched)
+			if serr != nil {
+				log.Println("[-] Failed to salvage the packfile:", serr)
+				f.exp.Add("salvagefail", 1)
+			}
+			if tips > 0 {
+				return partialError{err}
+			}
 			return err
 		}
-		packR.Close()
 		if r, ok := r.(*io.LimitedReader); ok && r.N <= 0 {
-			w.CloseWithError(errors.New("too big"))
-			f.i.AddBlacklist(name, "Too big.")
-			log.Printf("[-] Repository too big :(")
-			f.exp.Add("toobig", 1)
-			return nil
+			return errTooBig
 		}
-		w.Close()
+		packSize = bytesFetched
+		stats := v.Stats()
 		f.exp.Add("fetchtime", int64(time.Since(start)))
-		log.Printf("[+] Got %d refs, %d bytes in %s.", len(refs), bytesFetched, time.Since(start))
+		f.exp.Add("objects", int64(stats.Objects))
+		log.Printf("[+] Got %d refs, %d objects, %d bytes in %s.",
+			len(refs), stats.Objects, bytesFetched, time.Since(start))
+
+		packRefName, err = f.storePack(tmp, bytesFetched, deps)
+		if err != nil {
+			return err
+		}
 	} else {
 		// Empty packfile.
-		packRefName = "EMPTY|" + packRefName
+		packRefName = fmt.Sprintf("EMPTY|%s/%d", name, time.Now().UnixNano())
 		f.exp.Add("emptypack", 1)
 		log.Printf("[+] Got %d refs, and a empty packfile.", len(refs))
 	}
 
+	boundary := shallowBoundary(opts.Shallows, res)
+	if boundary != nil {
+		f.exp.Add("shallow", 1)
+		log.Printf("[+] The history is shallow, with %d boundary commits.", len(boundary))
+	}
+	if opts.Filter != "" {
+		f.exp.Add("filtered", 1)
+		log.Printf("[+] The packfile is partial, with filter %s.", opts.Filter)
+	}
+
 	if parent != "" {
 		parent = "github.com/" + parent
 	}
 
-	return f.i.AddFetch(name, parent, time.Now(), refs, packRefName, deps)
+	return f.i.AddFetch(name, parent, time.Now(), refs, res.Head(), boundary, opts.Filter, packRefName, packSize, deps)
 }
 
+// salvage archives the complete objects at the beginning of the packfile
+// of an interrupted fetch, of which r has the first size bytes, as a
+// partial fetch. It returns the number of complete commits, which are added
+// to the haves. Without any, it archives nothing, since the next fetch
+// couldn't use the objects.
+func (f *Fetcher) salvage(name, parent string, haves map[string]struct{}, deps []string,
+	opts *git.Options, res *git.Result, r io.ReaderAt, size int64) (tips int, err error) {
+
+	tmp, err := ioutil.TempFile("", "fetcher")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	objects, err := git.SalvagePack(r, size, tmp)
+	if err != nil || objects == 0 {
+		return 0, err
+	}
+	size, err = tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	// Thin deltas and the links of the commits can point anywhere down the
+	// chain of archived packs, not only to deps.
+	bases, err := f.store.Chain(deps)
+	if err != nil {
+		return 0, err
+	}
+	idx, err := git.IndexPack(tmp, size, bases)
+	if err != nil {
+		return 0, err
+	}
+	boundary := shallowBoundary(opts.Shallows, res)
+	complete, err := git.CompleteCommits(git.NewPack(tmp, idx, bases), boundary, opts.Filter != "")
+	if err != nil || len(complete) == 0 {
+		return 0, err
+	}
+
+	packRefName, stored, err := f.store.Put(tmp, size)
+	if err != nil {
+		return 0, err
+	}
+	if !stored {
+		f.exp.Add("dedupedpacks", 1)
+	}
+	if err := f.store.PutIndex(packRefName, idx); err != nil {
+		log.Println("[-] Failed to index the packfile:", err)
+		f.exp.Add("indexfail", 1)
+	}
+
+	newHaves := make(map[string]struct{})
+	for id := range haves {
+		newHaves[id] = struct{}{}
+	}
+	for _, id := range complete {
+		newHaves[id] = struct{}{}
+	}
+	if parent != "" {
+		parent = "github.com/" + parent
+	}
+	err = f.i.AddPartialFetch(name, parent, time.Now(), newHaves, boundary, opts.Filter, packRefName, size, deps)
+	if err != nil {
+		return 0, err
+	}
+	f.exp.Add("salvaged", 1)
+	f.exp.Add("salvagedobjects", int64(objects))
+	log.Printf("[+] Salvaged %d objects, with %d complete commits.", objects, len(complete))
+	return len(complete), nil
+}
+
+// progressNames are the names of the progress phases in the expvar map.
+var progressNames = map[git.ProgressPhase]string{
+	git.PhaseEnumerating: "enumerating",
+	git.PhaseCounting:    "counting",
+	git.PhaseCompressing: "compressing",
+	git.PhaseReceiving:   "receiving",
+}
+
+// slowPhase is the time after which a server phase is logged.
+const slowPhase = time.Minute
+
+// progress exports the progress of a fetch in inflight, its
+// "inflight/NAME" map, and adds up the time the servers spend on each
+// phase.
+func (f *Fetcher) progress(inflight *expvar.Map, p git.Progress) {
+	name := progressNames[p.Phase]
+	unit := "objects"
+	if p.Phase == git.PhaseReceiving {
+		unit = "bytes"
+	}
+	current, elapsed := new(expvar.Int), new(expvar.Int)
+	current.Set(p.Current)
+	elapsed.Set(int64(p.Elapsed))
+	inflight.Set(name+unit, current)
+	inflight.Set(name+"time", elapsed)
+
+	if p.Done && p.Phase != git.PhaseReceiving {
+		f.exp.Add(name+"time", int64(p.Elapsed))
+		if p.Elapsed > slowPhase {
+			log.Printf("[ ] The server spent %s %s.", p.Elapsed, strings.ToLower(string(p.Phase)))
+		}
+	}
+}
+
+// maxMessages is the number of sideband messages logged per fetch, and
+// maxMessageLen the length they are truncated to.
+const maxMessages, maxMessageLen = 20, 200
+
+// progressLineRe matches the progress updates of git, which are exported
+// by progress instead of logged.
+var progressLineRe = regexp.MustCompile(`^(\w[\w ]*: +(\d+% \(\d+/\d+\)|\d+)|Total \d+)`)
+
+// messageLog logs the sideband messages of a server but the progress
+// updates, line by line, up to maxMessages, so that a chatty or hostile
+// server can't flood the logs.
+type messageLog struct {
+	buf    []byte
+	logged int
+	// skip is set while the rest of a truncated line is dropped.
+	skip bool
+}
+
+func (m *messageLog) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	for {
+		i := bytes.IndexAny(m.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		if !m.skip {
+			m.line(string(m.buf[:i]))
+		}
+		m.buf, m.skip = m.buf[i+1:], false
+	}
+	if len(m.buf) > maxMessageLen {
+		if !m.skip {
+			m.line(string(m.buf))
+		}
+		m.buf, m.skip = m.buf[:0], true
+	}
+	return len(p), nil
+}
+
+func (m *messageLog) line(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || progressLineRe.MatchString(line) || m.logged > maxMessages {
+		return
+	}
+	m.logged++
+	if m.logged > maxMessages {
+		log.Println("[ ] remote: (more messages left out)")
+		return
+	}
+	if len(line) > maxMessageLen {
+		line = line[:maxMessageLen] + "..."
+	}
+	log.Printf("[ ] remote: %q", line)
+}
+
+// maxDatedHaves bounds the number of objects haveDates reads from storage,
+// each of which costs a round trip.
+const maxDatedHaves = 100
+
+// haveDates looks up the dates of the haves in the archived packs, so that
+// the negotiation can start from the newest. Errors only make it return
+// fewer dates.
+func (f *Fetcher) haveDates(haves map[string]struct{}, deps []string) map[string]time.Time {
+	if len(haves) == 0 || len(haves) > maxDatedHaves {
+		return nil
+	}
+	bases, err := f.store.Bases(deps)
+	if err != nil {
+		log.Println("[-] Can't read the archived packs:", err)
+		return nil
+	}
+	dates := make(map[string]time.Time)
+	for id := range haves {
+		t, data, err := bases.ReadObject(id)
+		if err != nil {
+			continue
+		}
+		if date, ok := git.ObjectDate(t, data); ok {
+			dates[id] = date
+		}
+	}
+	return dates
+}
+
+// shallowBoundary returns the shallow boundary of the archived history
+// after a fetch, given the previous one, or nil if the history is complete.
+func shallowBoundary(previous []string, res *git.Result) []string {
+	var boundary []string
+	unshallow := make(map[string]bool)
+	for _, id := range res.Unshallow {
+		unshallow[id] = true
+	}
+	seen := make(map[string]bool)
+	for _, ids := range [][]string{previous, res.Shallow} {
+		for _, id := range ids {
+			if unshallow[id] || seen[id] {
+				continue
+			}
+			seen[id] = true
+			boundary = append(boundary, id)
+		}
+	}
+	return boundary
+}
+
+// storePack stores the packfile r, size bytes long, under its checksum,
+// and indexes it, unless an identical one is there already. It returns its
+// packRef.
+func (f *Fetcher) storePack(r io.ReaderAt, size int64, deps []string) (string, error) {
+	packRef, stored, err := f.store.Put(r, size)
+	if err != nil {
+		return "", err
+	}
+	if !stored {
+		f.exp.Add("dedupedpacks", 1)
+		log.Printf("[+] The packfile is already stored as %s.", packRef)
+		if ok, err := f.store.HasIndex(packRef); ok && err == nil {
+			return packRef, nil
+		}
+	}
+
+	// A missing .idx can be backfilled later, so don't fail the fetch.
+	if err := f.writeIndex(packRef, r, size, deps); err != nil {
+		log.Println("[-] Failed to index the packfile:", err)
+		f.exp.Add("indexfail", 1)
+	}
+	return packRef, nil
+}
+
+// writeIndex stores the .idx of the packfile, resolving thin deltas against
+// the packs in deps.
+func (f *Fetcher) writeIndex(packRef string, r io.ReaderAt, size int64, deps []string) error {
+	start := time.Now()
+	bases, err := f.store.Bases(deps)
+	if err != nil {
+		return err
+	}
+	idx, err := f.store.WriteIndex(packRef, r, size, bases)
+	if err != nil {
+		return err
+	}
+	f.exp.Add("indextime", int64(time.Since(start)))
+	log.Printf("[+] Indexed %d objects in %s.", len(idx.Entries), time.Since(start))
+	return nil
+}
+
+// Stop makes the workers return after the fetches in progress, which are
+// aborted if they take longer than drainTimeout.
 func (f *Fetcher) Stop() {
-	atomic.StoreUint32(&f.closing, 1)
+	f.stopOnce.Do(func() {
+		close(f.stopping)
+		time.AfterFunc(f.drainTimeout, f.cancel)
+	})
 }
 
-func interruptableSleep(d time.Duration) bool {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	defer signal.Stop(c)
-	t := time.NewTimer(d)
+func (f *Fetcher) stopped() bool {
 	select {
-	case <-c:
+	case <-f.stopping:
+		return true
+	default:
 		return false
+	}
+}
+
+// sleep waits for d, or until Stop.
+func (f *Fetcher) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-f.stopping:
 	case <-t.C:
-		return true
 	}
 }
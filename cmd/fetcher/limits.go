@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// repoLocks keeps concurrent fetches apart: a fetch writes the archive of
+// its repository, and reads the one of its parent through GetHaves, so no
+// other fetch may touch its repository, and no fetch may write its parent.
+type repoLocks struct {
+	mu      sync.Mutex
+	writing map[string]bool
+	reading map[string]int
+}
+
+// tryLock locks name and parent for a fetch, and reports whether it could
+// without waiting.
+func (l *repoLocks) tryLock(name, parent string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.writing == nil {
+		l.writing, l.reading = make(map[string]bool), make(map[string]int)
+	}
+	if l.writing[name] || l.reading[name] > 0 || (parent != "" && l.writing[parent]) {
+		return false
+	}
+	l.writing[name] = true
+	if parent != "" {
+		l.reading[parent]++
+	}
+	return true
+}
+
+func (l *repoLocks) unlock(name, parent string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.writing, name)
+	if parent != "" {
+		if l.reading[parent]--; l.reading[parent] == 0 {
+			delete(l.reading, parent)
+		}
+	}
+}
+
+// bandwidthLimiter is a token bucket of bytes shared by the fetches, filled
+// at rate bytes per second, with up to a second worth of burst. A nil
+// bandwidthLimiter doesn't limit anything.
+type bandwidthLimiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newBandwidthLimiter returns a limiter of rate bytes per second, or nil if
+// rate is 0.
+func newBandwidthLimiter(rate int) *bandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, waiting until they are there. The
+// bucket can go into debt, so that the waiting fetches are served in turn.
+func (b *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reader returns r, reading from it no faster than the limiter allows.
+func (b *bandwidthLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, b: b}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	b   *bandwidthLimiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// Don't take more than the burst at once.
+	if len(p) > int(l.b.rate) {
+		p = p[:int(l.b.rate)]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if werr := l.b.wait(l.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
@@ -10,12 +10,14 @@ import (
 	"os/signal"
 	"strconv"
 	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
-	"google.golang.org/cloud/storage"
 
+	"github.com/thecodearchive/gitarchive/blobstore"
 	"github.com/thecodearchive/gitarchive/index"
 	"github.com/thecodearchive/gitarchive/metrics"
+	"github.com/thecodearchive/gitarchive/packstore"
 	"github.com/thecodearchive/gitarchive/queue"
 	"github.com/thecodearchive/gitarchive/weekmap"
 )
@@ -33,11 +35,10 @@ func main() {
 	err = metrics.StartInfluxExport(MustGetenv("INFLUX_ADDR"), "fetcher", exp)
 	fatalIfErr(err)
 
-	client, err := storage.NewClient(context.Background())
+	blobs, err := blobstore.Open(context.Background(),
+		OptGetenv("BLOB_STORE", "gs://"+OptGetenv("FETCHER_BUCKET_NAME", "packfiles")))
 	fatalIfErr(err)
 
-	bucket := client.Bucket(OptGetenv("FETCHER_BUCKET_NAME", "packfiles"))
-
 	log.Println("[ ] Opening queue...")
 	q, err := queue.Open(MustGetenv("DB_ADDR"))
 	fatalIfErr(err)
@@ -58,7 +59,28 @@ func main() {
 		fatalIfErr(i.Close())
 	}()
 
-	f := &Fetcher{exp: exp, q: q, i: i, bucket: bucket, schedule: schedule}
+	connectTimeout, err := time.ParseDuration(OptGetenv("CONNECT_TIMEOUT", "30s"))
+	fatalIfErr(err)
+	idleTimeout, err := time.ParseDuration(OptGetenv("IDLE_TIMEOUT", "5m"))
+	fatalIfErr(err)
+	fetchTimeout, err := time.ParseDuration(OptGetenv("FETCH_TIMEOUT", "6h"))
+	fatalIfErr(err)
+	drainTimeout, err := time.ParseDuration(OptGetenv("DRAIN_TIMEOUT", "20s"))
+	fatalIfErr(err)
+	retryBackoff, err := time.ParseDuration(OptGetenv("RETRY_BACKOFF", "5m"))
+	fatalIfErr(err)
+	maxBackoff, err := time.ParseDuration(OptGetenv("MAX_BACKOFF", "24h"))
+	fatalIfErr(err)
+	leaseTime, err := time.ParseDuration(OptGetenv("LEASE_TIME", "5m"))
+	fatalIfErr(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	store := packstore.New(ctx, blobs, i)
+	f := &Fetcher{exp: exp, q: q, i: i, store: store, schedule: schedule,
+		connectTimeout: connectTimeout, idleTimeout: idleTimeout, fetchTimeout: fetchTimeout,
+		retryBackoff: retryBackoff, maxBackoff: maxBackoff, leaseTime: leaseTime,
+		workers: OptGetenvInt("WORKERS", 1), bandwidth: newBandwidthLimiter(OptGetenvInt("MAX_BANDWIDTH", 0)),
+		stopping: make(chan struct{}), drainTimeout: drainTimeout, ctx: ctx, cancel: cancel}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -102,3 +124,15 @@ func OptGetenv(name, defaultVal string) string {
 	}
 	return val
 }
+
+func OptGetenvInt(name string, defaultVal int) int {
+	val := os.Getenv(name)
+	if val == "" {
+		return defaultVal
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		log.Panicln("Invalid environment variable:", name)
+	}
+	return i
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/thecodearchive/gitarchive/git"
+	"github.com/thecodearchive/gitarchive/index"
+	"github.com/thecodearchive/gitarchive/queue"
+)
+
+// maxAttempts is the number of times in a row a fetch can fail with a
+// transient error before the repository is given up on.
+var maxAttempts = OptGetenvInt("MAX_ATTEMPTS", 8)
+
+// errorClass is what to do with a repository after a failed fetch.
+type errorClass int
+
+const (
+	// transient errors, like timeouts, are retried later.
+	transient errorClass = iota
+
+	// permanent errors, like a repository that's gone, are only recorded.
+	permanent
+
+	// policy errors are decisions not to archive a repository, which go to
+	// the blacklist for review.
+	policy
+)
+
+// policyError is a policy decision, with the reason given in the blacklist.
+type policyError struct {
+	status, reason string
+}
+
+func (e policyError) Error() string {
+	return e.reason
+}
+
+// classify returns the class of err, and a short status describing it,
+// which is also the name of its counter.
+func classify(err error) (class errorClass, status string) {
+	switch err := err.(type) {
+	case policyError:
+		return policy, err.status
+	case partialError:
+		// Some progress was made, but the repository may never make it
+		// through, so it counts as an attempt.
+		return transient, "partial"
+	case git.RemoteError:
+		switch {
+		case strings.Contains(err.Message, "Repository not found."), strings.HasPrefix(err.Message, "404"):
+			return permanent, "vanished"
+		case strings.Contains(err.Message, "DMCA"):
+			return permanent, "dmca"
+		case strings.HasPrefix(err.Message, "401"), strings.HasPrefix(err.Message, "403"):
+			return permanent, "auth"
+		}
+		return permanent, "remote"
+	case git.HTTPError:
+		switch {
+		case err.StatusCode >= 500, err.StatusCode == 408, err.StatusCode == 429:
+			return transient, "http"
+		case err.StatusCode == 401, err.StatusCode == 403:
+			return permanent, "auth"
+		}
+		return permanent, "http"
+	case git.PackFormatError:
+		return transient, "badpack"
+	case net.Error:
+		if err.Timeout() {
+			return transient, "timeout"
+		}
+		return transient, "network"
+	}
+	if err == context.DeadlineExceeded {
+		return transient, "timeout"
+	}
+	return transient, "error"
+}
+
+// fail deals with the failed fetch of the repository of l: transient
+// errors are retried with exponential backoff, up to maxAttempts, permanent
+// ones are recorded in the index, and policy ones are blacklisted.
+func (f *Fetcher) fail(l *queue.Lease, err error) error {
+	fullName := "github.com/" + l.Name
+	class, status := classify(err)
+	f.exp.Add(status, 1)
+	if class == policy {
+		log.Printf("[-] Blacklisting %s: %v", fullName, err)
+		if err := f.i.AddBlacklist(fullName, err.Error()); err != nil {
+			log.Println("[-] Failed to blacklist:", err)
+		}
+		return leaseErr(f.q.Ack(l))
+	}
+
+	previous, ierr := f.i.GetFailure(fullName)
+	if ierr != nil {
+		return ierr
+	}
+	failure := &index.Failure{Name: fullName, Status: status, Error: err.Error(),
+		Permanent: class == permanent, Attempts: 1, Timestamp: time.Now()}
+	if previous != nil && !previous.Permanent {
+		failure.Attempts += previous.Attempts
+	}
+	if class == transient && failure.Attempts >= maxAttempts {
+		log.Printf("[-] Giving up after %d attempts: %v", failure.Attempts, err)
+		f.exp.Add("gaveup", 1)
+		failure.Permanent = true
+	}
+	if err := f.i.SetFailure(failure); err != nil {
+		return err
+	}
+	if failure.Permanent {
+		log.Printf("[-] Fetch failed (%s): %v", status, err)
+		return leaseErr(f.q.Ack(l))
+	}
+
+	delay := f.backoff(failure.Attempts)
+	log.Printf("[-] Fetch failed (%s), retrying in %s: %v", status, delay, err)
+	f.exp.Add("retried", 1)
+	return leaseErr(f.q.Nack(l, delay))
+}
+
+// backoff returns the delay before the next attempt after the given number
+// of failed ones, which doubles each time up to maxBackoff.
+func (f *Fetcher) backoff(attempts int) time.Duration {
+	d := f.retryBackoff
+	for n := 1; n < attempts && d < f.maxBackoff; n++ {
+		d *= 2
+	}
+	if d > f.maxBackoff {
+		d = f.maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"compress/gzip"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/thecodearchive/gitarchive/git"
+)
+
+// Archive serves /TIMESTAMP/github.com/USER/REPO/archive/REF.tar.gz and
+// REF.zip, the tree of REF as archived at TIMESTAMP. REF is a ref name or
+// an object ID, as for resolve.
+func (f *Frontend) Archive(w http.ResponseWriter, r *http.Request, timestamp, repo, name string) {
+	var ref, ext string
+	for _, e := range []string{".tar.gz", ".zip"} {
+		if strings.HasSuffix(name, e) {
+			ref, ext = strings.TrimSuffix(name, e), e
+		}
+	}
+	if ref == "" {
+		http.Error(w, "Unrecognized archive format", http.StatusNotFound)
+		return
+	}
+
+	u, fetch, ok := f.snapshot(w, timestamp, repo)
+	if !ok {
+		return
+	}
+	// An archive reads every object of the tree, so unlike checkout read
+	// them from local copies of the packs, as for upload-pack.
+	local, err := f.objects(fetch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer local.Close()
+	u.Objects = local
+
+	commit, rest, ok := resolve(w, u, ref)
+	if !ok {
+		return
+	}
+	if rest != "" {
+		http.Error(w, "Unknown ref", http.StatusNotFound)
+		return
+	}
+	if u.Filter != "" {
+		// The blobs left out by the filter would truncate the archive, so
+		// look for them before writing anything.
+		missing, err := git.MissingPath(u.Objects, commit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if missing != "" {
+			http.Error(w, "Incomplete snapshot, fetched with filter "+u.Filter+": "+missing+" is missing",
+				http.StatusNotFound)
+			return
+		}
+	}
+
+	// Like GitHub, everything is in a REPO-REF directory.
+	prefix := path.Base(repo) + "-" + strings.Replace(ref, "/", "-", -1)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+prefix+ext+`"`)
+	if ext == ".zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		err = git.WriteZip(w, u.Objects, commit, prefix+"/")
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		gw := gzip.NewWriter(w)
+		if err = git.WriteTar(gw, u.Objects, commit, prefix+"/"); err == nil {
+			err = gw.Close()
+		}
+	}
+	if err != nil {
+		// It's too late to tell the client, who gets a truncated archive.
+		log.Println("[-] Writing archive:", err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The browsing API answers under /_api/ with JSON, and the UI under /_ui/
+// with the same data as HTML:
+//
+//   repos?prefix=PREFIX&after=NAME           the archived repositories
+//   repos/github.com/USER/REPO?at=TIMESTAMP  the fetches and blacklist state
+//   repos/github.com/USER/REPO/diff?from=TIMESTAMP&to=TIMESTAMP
+//                                            the refs changed in between
+//
+// TIMESTAMP is anything parseTimestamp accepts.
+
+// reposPerPage is the number of repositories listed at once.
+const reposPerPage = 100
+
+type repoList struct {
+	Prefix string   `json:"prefix,omitempty"`
+	Repos  []string `json:"repos"`
+	// Next is the after parameter of the next page, if any.
+	Next string `json:"next,omitempty"`
+}
+
+type fetchInfo struct {
+	Timestamp time.Time `json:"timestamp"`
+	Refs      int       `json:"refs"`
+	// PackSize is -1 if unknown.
+	PackSize int64  `json:"pack_size"`
+	Parent   string `json:"parent,omitempty"`
+	Partial  bool   `json:"partial,omitempty"`
+}
+
+type snapshotInfo struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Head      string            `json:"head,omitempty"`
+	Refs      map[string]string `json:"refs"`
+}
+
+type repoInfo struct {
+	Name      string      `json:"name"`
+	Blacklist string      `json:"blacklist"`
+	Fetches   []fetchInfo `json:"fetches"`
+
+	// At is the snapshot at the time asked for, if any. AtMissing is set if
+	// there is none.
+	At        *snapshotInfo `json:"at,omitempty"`
+	AtMissing bool          `json:"-"`
+}
+
+type refDiff struct {
+	Name string `json:"name"`
+	// From and To are the times of the fetches compared, nil if there was
+	// nothing archived yet.
+	From    *time.Time           `json:"from"`
+	To      *time.Time           `json:"to"`
+	Added   map[string]string    `json:"added"`
+	Removed map[string]string    `json:"removed"`
+	Changed map[string][2]string `json:"changed"`
+}
+
+// Browse serves the API and the UI. path is the request path, starting
+// with "_api/" or "_ui/".
+func (f *Frontend) Browse(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET supported", http.StatusNotImplemented)
+		return
+	}
+	parts := strings.SplitN(path, "/", 2)
+	api, rest := parts[0] == "_api", ""
+	if len(parts) == 2 {
+		rest = parts[1]
+	}
+
+	var data interface{}
+	var tmpl string
+	var err error
+	switch parts := strings.Split(rest, "/"); {
+	case rest == "repos" || rest == "":
+		data, err = f.listRepos(r.FormValue("prefix"), r.FormValue("after"))
+		tmpl = "repos"
+	case len(parts) == 4 && parts[0] == "repos" && parts[1] == "github.com":
+		data, err = f.repoInfo(strings.Join(parts[1:], "/"), r.FormValue("at"))
+		tmpl = "repo"
+	case len(parts) == 5 && parts[0] == "repos" && parts[1] == "github.com" && parts[4] == "diff":
+		data, err = f.refDiff(strings.Join(parts[1:4], "/"), r.FormValue("from"), r.FormValue("to"))
+		tmpl = "diff"
+	default:
+		http.Error(w, "Unrecognized path", http.StatusNotFound)
+		return
+	}
+	if err, ok := err.(badRequest); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("[-] Browsing:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if api {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(data)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = templates.ExecuteTemplate(w, tmpl, data)
+	}
+	if err != nil {
+		log.Println("[-] Rendering:", err)
+	}
+}
+
+// badRequest is an error caused by the request parameters.
+type badRequest struct {
+	error
+}
+
+func (f *Frontend) listRepos(prefix, after string) (*repoList, error) {
+	if prefix == "" {
+		prefix = "github.com/"
+	}
+	repos, err := f.i.ListRepos(prefix, after, reposPerPage+1)
+	if err != nil {
+		return nil, err
+	}
+	res := &repoList{Prefix: prefix, Repos: repos}
+	if len(repos) > reposPerPage {
+		res.Repos = repos[:reposPerPage]
+		res.Next = repos[reposPerPage-1]
+	}
+	return res, nil
+}
+
+func (f *Frontend) repoInfo(name, at string) (*repoInfo, error) {
+	state, err := f.i.BlacklistState(name)
+	if err != nil {
+		return nil, err
+	}
+	fetches, err := f.i.ListFetches(name)
+	if err != nil {
+		return nil, err
+	}
+	res := &repoInfo{Name: name, Blacklist: state.String(), Fetches: []fetchInfo{}}
+	for _, fetch := range fetches {
+		size := fetch.PackSize
+		if size < 0 {
+			// Fetches from before the sizes were recorded.
+			if s, err := f.store.Size(fetch.PackRef); err == nil {
+				size = s
+			}
+		}
+		res.Fetches = append(res.Fetches, fetchInfo{Timestamp: fetch.Timestamp, Refs: len(fetch.Refs),
+			PackSize: size, Parent: fetch.Parent, Partial: fetch.Partial})
+	}
+
+	if at != "" {
+		t, err := parseTimestamp(at)
+		if err != nil {
+			return nil, badRequest{err}
+		}
+		fetch, err := f.i.GetFetchAt(name, t)
+		if err != nil {
+			return nil, err
+		}
+		if fetch != nil {
+			res.At = &snapshotInfo{Timestamp: fetch.Timestamp, Head: fetch.Head, Refs: fetch.Refs}
+		} else {
+			res.AtMissing = true
+		}
+	}
+	return res, nil
+}
+
+func (f *Frontend) refDiff(name, from, to string) (*refDiff, error) {
+	fromRefs, fromTime, err := f.refsAt(name, from)
+	if err != nil {
+		return nil, err
+	}
+	toRefs, toTime, err := f.refsAt(name, to)
+	if err != nil {
+		return nil, err
+	}
+	res := diffRefs(fromRefs, toRefs)
+	res.Name, res.From, res.To = name, fromTime, toTime
+	return res, nil
+}
+
+// refsAt returns the refs of name archived at timestamp, and the time of
+// their fetch, or nil if there are none.
+func (f *Frontend) refsAt(name, timestamp string) (map[string]string, *time.Time, error) {
+	if timestamp == "" {
+		return nil, nil, badRequest{errors.New("from and to are required")}
+	}
+	t, err := parseTimestamp(timestamp)
+	if err != nil {
+		return nil, nil, badRequest{err}
+	}
+	fetch, err := f.i.GetFetchAt(name, t)
+	if err != nil || fetch == nil {
+		return nil, nil, err
+	}
+	return fetch.Refs, &fetch.Timestamp, nil
+}
+
+// diffRefs returns the refs added, removed and changed from a to b.
+func diffRefs(a, b map[string]string) *refDiff {
+	res := &refDiff{Added: make(map[string]string), Removed: make(map[string]string),
+		Changed: make(map[string][2]string)}
+	for name, id := range a {
+		if newID, ok := b[name]; !ok {
+			res.Removed[name] = id
+		} else if newID != id {
+			res.Changed[name] = [2]string{id, newID}
+		}
+	}
+	for name, id := range b {
+		if _, ok := a[name]; !ok {
+			res.Added[name] = id
+		}
+	}
+	return res
+}
+
+// sortedKeys returns the keys of a map of refs, in order, for the
+// templates.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string][2]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"sortedKeys": sortedKeys,
+	"unix":       func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+	"date":       func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.}} - The Code Archive</title>
+<style>body{font-family:sans-serif;margin:2em}td,th{padding:0 1em 0 0;text-align:left}code{font-size:90%}</style>
+</head><body><p><a href="/_ui/repos">The Code Archive</a></p><h1>{{.}}</h1>{{end}}
+
+{{define "footer"}}</body></html>{{end}}
+
+{{define "repos"}}{{template "header" "Repositories"}}
+<form action="/_ui/repos"><input name="prefix" size="50" value="{{.Prefix}}"> <input type="submit" value="Search"></form>
+<ul>{{range .Repos}}<li><a href="/_ui/repos/{{.}}">{{.}}</a></li>{{else}}<li>Nothing archived.</li>{{end}}</ul>
+{{if .Next}}<p><a href="/_ui/repos?prefix={{.Prefix}}&amp;after={{.Next}}">Next page</a></p>{{end}}
+{{template "footer"}}{{end}}
+
+{{define "repo"}}{{template "header" .Name}}
+<p>Blacklist state: {{.Blacklist}}</p>
+<form action="/_ui/repos/{{.Name}}">Archived as of <input name="at" placeholder="2006-01-02T15:04:05Z"> <input type="submit" value="Check"></form>
+{{if .AtMissing}}<p>Not archived at that time.</p>{{end}}
+{{with .At}}<p>Latest fetch: {{date .Timestamp}}, clone it with <code>git clone https://HOST/{{unix .Timestamp}}/{{$.Name}}</code></p>
+<table>{{range $ref := sortedKeys .Refs}}<tr><td>{{$ref}}</td><td><code>{{index $.At.Refs $ref}}</code></td></tr>{{end}}</table>{{end}}
+<h2>Fetches</h2>
+<form action="/_ui/repos/{{.Name}}/diff">
+<table><tr><th>From</th><th>To</th><th>Time</th><th>Refs</th><th>Pack size</th><th>Parent</th></tr>
+{{range .Fetches}}<tr>
+{{if .Partial}}<td></td><td></td>{{else}}<td><input type="radio" name="from" value="{{unix .Timestamp}}"></td><td><input type="radio" name="to" value="{{unix .Timestamp}}"></td>{{end}}
+<td><a href="/_ui/repos/{{$.Name}}?at={{unix .Timestamp}}">{{date .Timestamp}}</a></td>
+<td>{{if .Partial}}partial{{else}}{{.Refs}}{{end}}</td><td>{{if ge .PackSize 0}}{{.PackSize}}{{else}}?{{end}}</td><td>{{.Parent}}</td>
+</tr>{{end}}</table>
+<input type="submit" value="Compare refs"></form>
+{{template "footer"}}{{end}}
+
+{{define "diff"}}{{template "header" .Name}}
+<p>Refs changed from {{with .From}}{{date .}}{{else}}nothing{{end}} to {{with .To}}{{date .}}{{else}}nothing{{end}}.</p>
+<table>
+{{range $ref := sortedKeys .Added}}<tr><td>+</td><td>{{$ref}}</td><td></td><td><code>{{index $.Added $ref}}</code></td></tr>{{end}}
+{{range $ref := sortedKeys .Removed}}<tr><td>-</td><td>{{$ref}}</td><td><code>{{index $.Removed $ref}}</code></td><td></td></tr>{{end}}
+{{range $ref := sortedKeys .Changed}}{{$ids := index $.Changed $ref}}<tr><td>~</td><td>{{$ref}}</td><td><code>{{index $ids 0}}</code></td><td><code>{{index $ids 1}}</code></td></tr>{{end}}
+</table>
+{{template "footer"}}{{end}}
+`))
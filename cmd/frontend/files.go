@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/thecodearchive/gitarchive/git"
+)
+
+type treeEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Type is "tree", "blob", "symlink" or "submodule".
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+	ID   string `json:"id"`
+}
+
+type treeListing struct {
+	Commit  string      `json:"commit"`
+	Path    string      `json:"path"`
+	Entries []treeEntry `json:"entries"`
+}
+
+func entryType(mode uint32) string {
+	switch mode {
+	case 040000:
+		return "tree"
+	case 0120000:
+		return "symlink"
+	case git.ModeSubmodule:
+		return "submodule"
+	}
+	return "blob"
+}
+
+// Tree serves /TIMESTAMP/github.com/USER/REPO/tree/REF/PATH, the listing of
+// the directory PATH of REF as archived at TIMESTAMP, in JSON. Files are
+// redirected to raw.
+func (f *Frontend) Tree(w http.ResponseWriter, r *http.Request, timestamp, repo, refPath string) {
+	u, commit, p, ok := f.checkout(w, timestamp, repo, refPath)
+	if !ok {
+		return
+	}
+	entry, ok := findPath(w, u.Objects, commit, p)
+	if !ok {
+		return
+	}
+	if entry.Mode != 040000 {
+		http.Redirect(w, r, "../"+strings.Repeat("../", strings.Count(refPath, "/"))+"raw/"+refPath,
+			http.StatusFound)
+		return
+	}
+
+	_, data, err := u.Objects.ReadObject(entry.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries, err := git.ParseTree(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p = strings.Trim(p, "/")
+	res := &treeListing{Commit: commit, Path: p, Entries: []treeEntry{}}
+	for _, e := range entries {
+		res.Entries = append(res.Entries, treeEntry{Name: e.Name, Path: path.Join(p, e.Name),
+			Type: entryType(e.Mode), Mode: fmt.Sprintf("%06o", e.Mode), ID: e.ID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		log.Println("[-] Writing tree:", err)
+	}
+}
+
+// Raw serves /TIMESTAMP/github.com/USER/REPO/raw/REF/PATH, the contents of
+// the file PATH of REF as archived at TIMESTAMP. Symlinks are served as
+// their target, and directories are redirected to tree.
+func (f *Frontend) Raw(w http.ResponseWriter, r *http.Request, timestamp, repo, refPath string) {
+	u, commit, p, ok := f.checkout(w, timestamp, repo, refPath)
+	if !ok {
+		return
+	}
+	entry, ok := findPath(w, u.Objects, commit, p)
+	if !ok {
+		return
+	}
+	switch entry.Mode {
+	case 040000:
+		http.Redirect(w, r, "../"+strings.Repeat("../", strings.Count(refPath, "/"))+"tree/"+refPath,
+			http.StatusFound)
+		return
+	case git.ModeSubmodule:
+		http.Error(w, "Submodule at "+entry.ID, http.StatusNotFound)
+		return
+	}
+
+	_, data, err := u.Objects.ReadObject(entry.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The files are served from our domain, so they can't be pages.
+	ctype := mime.TypeByExtension(path.Ext(p))
+	if ctype == "" || entry.Mode == 0120000 {
+		ctype = http.DetectContentType(data)
+	}
+	if strings.HasPrefix(ctype, "text/") || strings.Contains(ctype, "javascript") ||
+		strings.Contains(ctype, "xml") || strings.Contains(ctype, "json") {
+		ctype = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+entry.ID+`"`)
+	if _, err := w.Write(data); err != nil {
+		log.Println("[-] Writing raw file:", err)
+	}
+}
+
+// findPath returns the entry at path in commit. If it can't, it writes the
+// error to w and returns false.
+func findPath(w http.ResponseWriter, objects git.ObjectReader, commit, path string) (git.TreeEntry, bool) {
+	entry, err := git.FindPath(objects, commit, path)
+	if err == git.ErrPathNotFound {
+		http.Error(w, "No such file or directory", http.StatusNotFound)
+		return entry, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return entry, false
+	}
+	return entry, true
+}
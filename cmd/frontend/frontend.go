@@ -3,37 +3,34 @@ package main
 import (
 	"expvar"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/thecodearchive/gitarchive/git"
 	"github.com/thecodearchive/gitarchive/index"
-	"google.golang.org/cloud/storage"
+	"github.com/thecodearchive/gitarchive/packstore"
 )
 
 type Frontend struct {
-	i      *index.Index
-	bucket *storage.BucketHandle
+	i     *index.Index
+	store *packstore.Store
 
 	exp *expvar.Map
 }
 
-const capabilities = "thin-pack side-band side-band-64k ofs-delta shallow agent=github.com/thecodearchive/gitarchive"
-
-var testRefs = map[string]string{
-	"HEAD":              "7ec915048d870617a6d497294923bb2262e0659e",
-	"refs/heads/master": "7ec915048d870617a6d497294923bb2262e0659e",
-}
-
 func (f *Frontend) Handle(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(strings.TrimLeft(r.URL.Path, "/"),
 		"api/v1/proxy/namespaces/default/services/frontend/")
 
+	if path == "" || strings.HasPrefix(path, "_api/") || strings.HasPrefix(path, "_ui/") {
+		f.Browse(w, r, path)
+		return
+	}
+
 	// /TIMESTAMP/github.com/USER/REPO/info/refs?service=git-upload-pack
 	parts := strings.SplitN(path, "/", 5)
 	if len(parts) != 5 {
@@ -44,14 +41,21 @@ func (f *Frontend) Handle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unrecognized repository", http.StatusNotFound)
 		return
 	}
-	repo := strings.Join(parts[1:4], "/")
+	repo := strings.TrimSuffix(strings.Join(parts[1:4], "/"), ".git")
 	timestamp := parts[0]
 
-	if r.Method == "GET" {
-		f.FetchRefs(w, r, timestamp, repo, parts[4])
-	} else if r.Method == "POST" {
-		f.PostObjects(w, r, timestamp, repo, parts[4])
-	} else {
+	switch extra := parts[4]; {
+	case r.Method == "GET" && strings.HasPrefix(extra, "archive/"):
+		f.Archive(w, r, timestamp, repo, strings.TrimPrefix(extra, "archive/"))
+	case r.Method == "GET" && strings.HasPrefix(extra, "tree/"):
+		f.Tree(w, r, timestamp, repo, strings.TrimPrefix(extra, "tree/"))
+	case r.Method == "GET" && strings.HasPrefix(extra, "raw/"):
+		f.Raw(w, r, timestamp, repo, strings.TrimPrefix(extra, "raw/"))
+	case r.Method == "GET":
+		f.FetchRefs(w, r, timestamp, repo, extra)
+	case r.Method == "POST":
+		f.PostObjects(w, r, timestamp, repo, extra)
+	default:
 		http.Error(w, "Only GET supported", http.StatusNotImplemented)
 	}
 
@@ -68,22 +72,16 @@ func (f *Frontend) FetchRefs(w http.ResponseWriter, r *http.Request, timestamp,
 		return
 	}
 
+	u, _, ok := f.snapshot(w, timestamp, repo)
+	if !ok {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
 
-	writePackLine(w, "# service=git-upload-pack")
-	fmt.Fprint(w, "0000") // This is required. Don't ask why.
-	firstLine := true
-	for name, ref := range testRefs {
-		extra := ""
-		if firstLine {
-			extra = "\x00" + capabilities
-			firstLine = false
-		}
-		writePackLine(w, ref+" "+name+extra)
+	if err := u.AdvertiseRefs(w, true); err != nil {
+		log.Println("[-] Advertising refs:", err)
 	}
-	fmt.Fprint(w, "0000")
-
-	log.Println("GET worked")
 }
 
 func (f *Frontend) PostObjects(w http.ResponseWriter, r *http.Request, timestamp, repo, extra string) {
@@ -92,61 +90,165 @@ func (f *Frontend) PostObjects(w http.ResponseWriter, r *http.Request, timestamp
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	u, fetch, ok := f.snapshot(w, timestamp, repo)
+	if !ok {
+		return
+	}
 
-	gitR, cmd, err := runGitUploadPack(r.Body)
+	local, err := f.objects(fetch)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = io.Copy(w, io.TeeReader(gitR, os.Stdout))
+	defer local.Close()
+	u.Objects = local
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+
+	if err := u.Serve(r.Body, w, true); err != nil {
+		log.Println("[-] Serving upload-pack:", err)
+	}
+}
+
+// objects returns the objects of fetch, read from local copies of its pack
+// and the chain of its dependencies, for upload-pack.
+func (f *Frontend) objects(fetch *index.Fetch) (*packstore.Local, error) {
+	packIDs, err := f.packIDs(fetch)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-	cmd.Wait()
+	return f.store.Local(packIDs)
 }
 
-func writePackLine(w io.Writer, line string) {
-	line = line + "\n"
-	fmt.Fprintf(w, "%04x%s", len(line)+4, line)
+// packIDs returns the packs fetch needs, along with their dependencies,
+// which for a fork can go through the packs of its parent. The parent fetch
+// of the time is added anyway, in case the fork was fetched without them.
+func (f *Frontend) packIDs(fetch *index.Fetch) ([]string, error) {
+	packIDs := []string{fetch.PackID}
+	if fetch.Parent != "" {
+		parent, err := f.i.GetFetchAt(fetch.Parent, fetch.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if parent != nil {
+			packIDs = append(packIDs, parent.PackID)
+		}
+	}
+	return packIDs, nil
 }
 
-func runGitUploadPack(r io.Reader) (io.Reader, *exec.Cmd, error) {
-	cmd := exec.Command("git-upload-pack", "/testrepo")
-	cmd.Stdin = r
-	pr, err := cmd.StdoutPipe()
+// checkout resolves refPath in the snapshot of repo at timestamp, like
+// resolve. It returns the snapshot, with its Objects read with range
+// requests, which suits lookups of a few objects, the commit, and the rest
+// of refPath. If it can't, it writes the error to w and returns false.
+func (f *Frontend) checkout(w http.ResponseWriter, timestamp, repo, refPath string) (u *git.UploadPack, commit, rest string, ok bool) {
+	u, fetch, ok := f.snapshot(w, timestamp, repo)
+	if !ok {
+		return nil, "", "", false
+	}
+	packIDs, err := f.packIDs(fetch)
 	if err != nil {
-		return nil, nil, err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, "", "", false
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, nil, err
+	if u.Objects, err = f.store.Chain(packIDs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, "", "", false
 	}
+	commit, rest, ok = resolve(w, u, refPath)
+	return u, commit, rest, ok
+}
 
-	// Discard the advertisement
-	for {
-		pktLenHex := make([]byte, 4)
-		if _, err := io.ReadFull(pr, pktLenHex); err == io.EOF {
-			return nil, nil, io.ErrUnexpectedEOF
-		} else if err != nil {
-			return nil, nil, err
+// resolve resolves refPath, which is a ref or an object ID followed by a
+// path, against the refs and objects of u. It returns the commit and the
+// rest of refPath. If it can't, it writes the error to w and returns false.
+func resolve(w http.ResponseWriter, u *git.UploadPack, refPath string) (commit, rest string, ok bool) {
+	// Refs can contain slashes, so the longest one that matches wins.
+	parts := strings.Split(refPath, "/")
+	for i := len(parts); i > 0; i-- {
+		ref := strings.Join(parts[:i], "/")
+		id, found := resolveRef(u.Refs, ref)
+		if !found && objectIDRe.MatchString(ref) && git.HasObject(u.Objects, ref) {
+			id, found = ref, true
 		}
-		pktLen, err := strconv.ParseUint(string(pktLenHex), 16, 16)
+		if !found {
+			continue
+		}
+		commit, err := git.PeelCommit(u.Objects, id)
 		if err != nil {
-			return nil, nil, err
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return "", "", false
 		}
+		return commit, strings.Join(parts[i:], "/"), true
+	}
+	http.Error(w, "Unknown ref", http.StatusNotFound)
+	return "", "", false
+}
 
-		// "0000" marker
-		if pktLen == 0 {
-			break
-		}
+// objectIDRe matches a full object ID.
+var objectIDRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
 
-		if _, err := io.CopyN(ioutil.Discard, pr, int64(pktLen-4)); err != nil {
-			return nil, nil, err
+// resolveRef returns what the ref name points to among refs. Like git, it
+// tries name itself, then as a tag, then as a branch.
+func resolveRef(refs map[string]string, name string) (string, bool) {
+	for _, full := range []string{name, "refs/" + name, "refs/tags/" + name, "refs/heads/" + name} {
+		if id, ok := refs[full]; ok {
+			return id, true
 		}
 	}
+	return "", false
+}
+
+// parseTimestamp parses the TIMESTAMP part of the path, which is "latest",
+// an RFC 3339 time or a Unix timestamp.
+func parseTimestamp(timestamp string) (time.Time, error) {
+	if timestamp == "latest" {
+		return time.Now(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
+		return t, nil
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad timestamp %q, expected latest, RFC 3339 or Unix", timestamp)
+	}
+	return time.Unix(sec, 0), nil
+}
 
-	return pr, cmd, nil
+// snapshot returns an UploadPack serving the refs of repo as archived at
+// timestamp, without Objects, and the fetch they come from. If it can't, it
+// writes the error to w and returns false.
+func (f *Frontend) snapshot(w http.ResponseWriter, timestamp, repo string) (u *git.UploadPack, fetch *index.Fetch, ok bool) {
+	t, err := parseTimestamp(timestamp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	fetch, err = f.i.GetFetchAt(repo, t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if fetch == nil {
+		http.Error(w, "Repository not archived at that time", http.StatusNotFound)
+		return nil, nil, false
+	}
+	u = &git.UploadPack{Refs: fetch.Refs, Shallow: fetch.Shallow, Filter: fetch.Filter}
+	if u.Filter == "" && fetch.Parent != "" {
+		// The objects of the parent may be missing too.
+		parent, err := f.i.GetFetchAt(fetch.Parent, fetch.Timestamp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, nil, false
+		}
+		if parent != nil {
+			u.Filter = parent.Filter
+		}
+	}
+	if fetch.Head != "" {
+		u.Symrefs = map[string]string{"HEAD": fetch.Head}
+	}
+	return u, fetch, true
 }
 
 func (f *Frontend) Run() error {
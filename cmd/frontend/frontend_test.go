@@ -0,0 +1,129 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/thecodearchive/gitarchive/blobstore"
+	"github.com/thecodearchive/gitarchive/git"
+	"github.com/thecodearchive/gitarchive/index"
+	"github.com/thecodearchive/gitarchive/packstore"
+)
+
+func runGit(t *testing.T, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+// archive fetches work as name on top of its previous fetches, and stores
+// the packfile and its index like the fetcher does.
+func archive(t *testing.T, i *index.Index, store *packstore.Store, name, work string, timestamp time.Time) {
+	haves, _, deps, err := i.GetHaves(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := git.FetchWithOptions(work, haves, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Pack == nil {
+		t.Fatal("no packfile")
+	}
+	tmp, err := ioutil.TempFile("", "frontend-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, res.Pack)
+	res.Pack.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packRef, _, err := store.Put(tmp, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bases, err := store.Bases(deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteIndex(packRef, tmp, size, bases); err != nil {
+		t.Fatal(err)
+	}
+	err = i.AddFetch(name, "", timestamp, res.Refs, res.Head(), nil, "", packRef, size, deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRawThroughChain(t *testing.T) {
+	if os.Getenv("TEST_MYSQL_DSN") == "" {
+		t.Skip("TEST_MYSQL_DSN missing, skipping MySQL test")
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found, skipping")
+	}
+	dir, err := ioutil.TempDir("", "frontend-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobs, err := blobstore.NewLocal(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := index.Open(os.Getenv("TEST_MYSQL_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	store := packstore.New(context.Background(), blobs, i)
+	f := &Frontend{i: i, store: store, exp: new(expvar.Map).Init()}
+
+	// Three fetches, the last of which has a delta against a blob of the
+	// first, since "other" doesn't change in the second.
+	name := fmt.Sprintf("github.com/test/chain%d", time.Now().UnixNano())
+	work := filepath.Join(dir, "work")
+	runGit(t, "init", "-q", work)
+	runGit(t, "-C", work, "symbolic-ref", "HEAD", "refs/heads/master")
+	other := strings.Repeat("some other line of text\n", 200)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for n, change := range []struct{ name, content string }{
+		{"other", other},
+		{"file", "a file\n"},
+		{"other", other + "one more change\n"},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(work, change.name), []byte(change.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, "-C", work, "add", change.name)
+		runGit(t, "-C", work, "commit", "-q", "-m", "change "+change.name)
+		archive(t, i, store, name, work, start.Add(time.Duration(n)*time.Minute))
+	}
+
+	w := httptest.NewRecorder()
+	f.Handle(w, httptest.NewRequest("GET", "/latest/"+name+"/raw/master/other", nil))
+	if w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if got, expected := w.Body.String(), other+"one more change\n"; got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
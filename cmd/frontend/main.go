@@ -12,10 +12,11 @@ import (
 	"syscall"
 
 	"golang.org/x/net/context"
-	"google.golang.org/cloud/storage"
 
+	"github.com/thecodearchive/gitarchive/blobstore"
 	"github.com/thecodearchive/gitarchive/index"
 	"github.com/thecodearchive/gitarchive/metrics"
+	"github.com/thecodearchive/gitarchive/packstore"
 )
 
 func main() {
@@ -28,11 +29,10 @@ func main() {
 	err := metrics.StartInfluxExport(MustGetenv("INFLUX_ADDR"), "frontend", exp)
 	fatalIfErr(err)
 
-	client, err := storage.NewClient(context.Background())
+	blobs, err := blobstore.Open(context.Background(),
+		OptGetenv("BLOB_STORE", "gs://"+OptGetenv("FETCHER_BUCKET_NAME", "packfiles")))
 	fatalIfErr(err)
 
-	bucket := client.Bucket(OptGetenv("FETCHER_BUCKET_NAME", "packfiles"))
-
 	log.Println("[ ] Opening index...")
 	i, err := index.Open(MustGetenv("DB_ADDR"))
 	fatalIfErr(err)
@@ -41,7 +41,8 @@ func main() {
 		fatalIfErr(i.Close())
 	}()
 
-	f := &Frontend{exp: exp, i: i, bucket: bucket}
+	store := packstore.New(context.Background(), blobs, i)
+	f := &Frontend{exp: exp, i: i, store: store}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
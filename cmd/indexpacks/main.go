@@ -0,0 +1,81 @@
+// Command indexpacks stores the missing .idx files of the archived packs.
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/thecodearchive/gitarchive/blobstore"
+	"github.com/thecodearchive/gitarchive/index"
+	"github.com/thecodearchive/gitarchive/packstore"
+)
+
+func main() {
+	blobs, err := blobstore.Open(context.Background(),
+		OptGetenv("BLOB_STORE", "gs://"+OptGetenv("FETCHER_BUCKET_NAME", "packfiles")))
+	fatalIfErr(err)
+
+	log.Println("[ ] Opening index...")
+	i, err := index.Open(MustGetenv("DB_ADDR"))
+	fatalIfErr(err)
+	defer func() {
+		log.Println("[ ] Closing index...")
+		fatalIfErr(i.Close())
+	}()
+
+	var closing uint32
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Println("[ ] Stopping gracefully...")
+		atomic.StoreUint32(&closing, 1)
+	}()
+
+	packs, err := i.ListPacks()
+	fatalIfErr(err)
+
+	// Dependencies always come before the packs that need them.
+	store := packstore.New(context.Background(), blobs, i)
+	var indexed int
+	for _, packID := range packs {
+		if atomic.LoadUint32(&closing) == 1 {
+			break
+		}
+		ok, err := store.Backfill(packID)
+		fatalIfErr(err)
+		if ok {
+			log.Printf("[+] Indexed pack %s.", packID)
+			indexed++
+		}
+	}
+	log.Printf("[+] Indexed %d packs out of %d.", indexed, len(packs))
+}
+
+func fatalIfErr(err error) {
+	if err != nil {
+		log.Printf("%+v", err)
+		panic("fatal error") // panic to let the defer run
+	}
+}
+
+func MustGetenv(name string) string {
+	val := os.Getenv(name)
+	if val == "" {
+		log.Panicln("Missing environment variable:", name)
+	}
+	return val
+}
+
+func OptGetenv(name, defaultVal string) string {
+	val := os.Getenv(name)
+	if val == "" {
+		return defaultVal
+	}
+	return val
+}
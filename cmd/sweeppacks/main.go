@@ -0,0 +1,62 @@
+// Command sweeppacks deletes the stored packfiles that no fetch references
+// anymore, since identical packfiles are shared by their fetches.
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/thecodearchive/gitarchive/blobstore"
+	"github.com/thecodearchive/gitarchive/index"
+	"github.com/thecodearchive/gitarchive/packstore"
+)
+
+func main() {
+	blobs, err := blobstore.Open(context.Background(),
+		OptGetenv("BLOB_STORE", "gs://"+OptGetenv("FETCHER_BUCKET_NAME", "packfiles")))
+	fatalIfErr(err)
+
+	// The packfiles are stored before their fetch is recorded, so leave
+	// the recent ones alone.
+	grace, err := time.ParseDuration(OptGetenv("SWEEP_GRACE", "24h"))
+	fatalIfErr(err)
+
+	log.Println("[ ] Opening index...")
+	i, err := index.Open(MustGetenv("DB_ADDR"))
+	fatalIfErr(err)
+	defer func() {
+		log.Println("[ ] Closing index...")
+		fatalIfErr(i.Close())
+	}()
+
+	store := packstore.New(context.Background(), blobs, i)
+	deleted, err := store.Sweep(grace)
+	log.Printf("[+] Deleted %d unreferenced blobs.", deleted)
+	fatalIfErr(err)
+}
+
+func fatalIfErr(err error) {
+	if err != nil {
+		log.Printf("%+v", err)
+		panic("fatal error") // panic to let the defer run
+	}
+}
+
+func MustGetenv(name string) string {
+	val := os.Getenv(name)
+	if val == "" {
+		log.Panicln("Missing environment variable:", name)
+	}
+	return val
+}
+
+func OptGetenv(name, defaultVal string) string {
+	val := os.Getenv(name)
+	if val == "" {
+		return defaultVal
+	}
+	return val
+}
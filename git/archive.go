@@ -0,0 +1,235 @@
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// PeelCommit follows the annotated tags starting at id down to a commit,
+// and returns its ID.
+func PeelCommit(r ObjectReader, id string) (string, error) {
+	for {
+		t, data, err := r.ReadObject(id)
+		if err != nil {
+			return "", fmt.Errorf("reading %s: %v", id, err)
+		}
+		switch t {
+		case ObjCommit:
+			return id, nil
+		case ObjTag:
+			links, err := objectLinks(t, data, nil)
+			if err != nil {
+				return "", err
+			}
+			if len(links) != 1 {
+				return "", fmt.Errorf("malformed tag %s", id)
+			}
+			id = links[0]
+		default:
+			return "", fmt.Errorf("%s is a %s, not a commit", id, t)
+		}
+	}
+}
+
+// archiveEntry is a file, directory or symlink of the tree being archived.
+type archiveEntry struct {
+	// path is relative to the root of the archive, with a trailing slash
+	// for directories.
+	path string
+	mode os.FileMode
+	// data is the contents of files, and the target of symlinks.
+	data []byte
+}
+
+// walkArchive calls f with the entries of tree, under prefix, as git
+// archive lists them: in tree order, each directory before its contents.
+// Submodules are empty directories. Like git archive with the default
+// umask, files are 0664 or 0775, and directories 0775.
+func walkArchive(r ObjectReader, tree, prefix string, f func(archiveEntry) error) error {
+	_, data, err := r.ReadObject(tree)
+	if err != nil {
+		return fmt.Errorf("reading tree %s: %v", tree, err)
+	}
+	entries, err := ParseTree(data)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		path := prefix + e.Name
+		switch e.Mode {
+		case 040000:
+			if err := f(archiveEntry{path: path + "/", mode: os.ModeDir | 0775}); err != nil {
+				return err
+			}
+			if err := walkArchive(r, e.ID, path+"/", f); err != nil {
+				return err
+			}
+			continue
+		case ModeSubmodule:
+			if err := f(archiveEntry{path: path + "/", mode: os.ModeDir | 0775}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, data, err := r.ReadObject(e.ID)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", path, err)
+		}
+		entry := archiveEntry{path: path, mode: 0664, data: data}
+		switch {
+		case e.Mode == 0120000:
+			entry.mode = os.ModeSymlink | 0777
+		case e.Mode&0111 != 0:
+			entry.mode = 0775
+		}
+		if err := f(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MissingPath returns the path of the first object missing from the tree
+// of commit, like a blob left out by a filtered fetch, or "" if there is
+// none. The blobs are only looked up, so that it's cheap to call before
+// WriteTar or WriteZip, which can't report errors once they have started.
+func MissingPath(r ObjectReader, commit string) (string, error) {
+	tree, _, err := commitTreeDate(r, commit)
+	if err != nil {
+		return "", err
+	}
+	return missingPath(r, tree, "")
+}
+
+func missingPath(r ObjectReader, tree, prefix string) (string, error) {
+	_, data, err := r.ReadObject(tree)
+	if err == ErrObjectNotFound {
+		return prefix, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading tree %s: %v", tree, err)
+	}
+	entries, err := ParseTree(data)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		path := prefix + e.Name
+		switch e.Mode {
+		case 040000:
+			if missing, err := missingPath(r, e.ID, path+"/"); missing != "" || err != nil {
+				return missing, err
+			}
+		case ModeSubmodule:
+		default:
+			if !HasObject(r, e.ID) {
+				return path, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// WriteTar writes a tar archive of the tree of commit to w, like git
+// archive --prefix=prefix. It records the commit ID in a pax global
+// header, and the committer date as the time of the entries.
+//
+// The objects are read from r, so the archive can be made from the
+// archived packs alone.
+func WriteTar(w io.Writer, r ObjectReader, commit, prefix string) error {
+	tree, date, err := commitTreeDate(r, commit)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	hdr := &tar.Header{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": commit}}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	writeEntry := func(e archiveEntry) error {
+		hdr := &tar.Header{Name: e.path, Mode: int64(e.mode.Perm()), ModTime: date,
+			Uname: "root", Gname: "root", Format: tar.FormatPAX}
+		switch {
+		case e.mode.IsDir():
+			hdr.Typeflag = tar.TypeDir
+		case e.mode&os.ModeSymlink != 0:
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, string(e.data)
+		default:
+			hdr.Typeflag, hdr.Size = tar.TypeReg, int64(len(e.data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(e.data)
+			return err
+		}
+		return nil
+	}
+	if strings.HasSuffix(prefix, "/") {
+		if err := writeEntry(archiveEntry{path: prefix, mode: os.ModeDir | 0775}); err != nil {
+			return err
+		}
+	}
+	if err := walkArchive(r, tree, prefix, writeEntry); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// WriteZip writes a zip archive of the tree of commit to w, like git
+// archive --format=zip --prefix=prefix. The commit ID is the comment of
+// the archive.
+func WriteZip(w io.Writer, r ObjectReader, commit, prefix string) error {
+	tree, date, err := commitTreeDate(r, commit)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	if err := zw.SetComment(commit); err != nil {
+		return err
+	}
+	writeEntry := func(e archiveEntry) error {
+		hdr := &zip.FileHeader{Name: e.path, Method: zip.Deflate, Modified: date}
+		hdr.SetMode(e.mode)
+		if e.mode.IsDir() {
+			hdr.Method = zip.Store
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(e.data)
+		return err
+	}
+	if strings.HasSuffix(prefix, "/") {
+		if err := writeEntry(archiveEntry{path: prefix, mode: os.ModeDir | 0775}); err != nil {
+			return err
+		}
+	}
+	if err := walkArchive(r, tree, prefix, writeEntry); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// commitTreeDate returns the tree and the committer date of commit.
+func commitTreeDate(r ObjectReader, commit string) (tree string, date time.Time, err error) {
+	t, data, err := r.ReadObject(commit)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("reading %s: %v", commit, err)
+	}
+	if t != ObjCommit {
+		return "", time.Time{}, fmt.Errorf("%s is a %s, not a commit", commit, t)
+	}
+	date, _ = ObjectDate(t, data)
+	return parseCommit(data).tree, date, nil
+}
@@ -0,0 +1,176 @@
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// tarEntry is what the tests compare of the entries of a tar archive.
+type tarEntry struct {
+	Name, Linkname string
+	Typeflag       byte
+	Mode           int64
+	Data           string
+}
+
+func readTar(t *testing.T, archive []byte) (entries []tarEntry, comment string) {
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, comment
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			comment = hdr.PAXRecords["comment"]
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{Name: hdr.Name, Linkname: hdr.Linkname,
+			Typeflag: hdr.Typeflag, Mode: hdr.Mode, Data: string(data)})
+	}
+}
+
+func TestWriteArchive(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo.git")
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+	first := archivedRepo(t, repo, nil)
+
+	// A second, thin pack adds a directory, an executable and a symlink,
+	// and changes file, with a delta against the first pack.
+	if err := os.MkdirAll(filepath.Join(work, "dir", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, perm := range map[string]os.FileMode{"dir/sub/a": 0644, "dir/run.sh": 0755} {
+		if err := ioutil.WriteFile(filepath.Join(work, name), []byte(name+"\n"), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("dir/sub/a", filepath.Join(work, "link")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(work, "file"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("one more change\n")
+	f.Close()
+	runGit(t, "-C", work, "add", "-A")
+	runGit(t, "-C", work, "commit", "-q", "-m", "more files")
+	runGit(t, "-C", work, "tag", "-a", "-m", "v2", "v2")
+	runGit(t, "-C", work, "push", "-q", repo, "master", "v2")
+
+	haves := make(map[string]struct{})
+	for _, id := range first.Refs {
+		haves[id] = struct{}{}
+	}
+	res, err := FetchWithOptions(repo, haves, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := ioutil.ReadAll(res.Pack)
+	res.Pack.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IndexPack(bytes.NewReader(pack), int64(len(pack)), nil); err == nil {
+		t.Fatal("the second pack is not thin")
+	}
+	chain := MultiObjectReader{first.Objects}
+	chain = append(chain, indexedPack(t, pack, chain))
+
+	commit, err := PeelCommit(chain, res.Refs["refs/tags/v2"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := runGit(t, "-C", repo, "rev-parse", "v2^{commit}"); commit != expected {
+		t.Fatalf("peeled v2 to %s, expected %s", commit, expected)
+	}
+
+	if missing, err := MissingPath(chain, commit); missing != "" || err != nil {
+		t.Fatalf("MissingPath: %q, %v", missing, err)
+	}
+
+	var tarball bytes.Buffer
+	if err := WriteTar(&tarball, chain, commit, "repo-v2/"); err != nil {
+		t.Fatal(err)
+	}
+	gitTar, err := exec.Command("git", "-C", repo, "archive", "--prefix=repo-v2/", commit).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, comment := readTar(t, tarball.Bytes())
+	expected, expectedComment := readTar(t, gitTar)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got entries %+v, expected %+v", got, expected)
+	}
+	if comment != expectedComment {
+		t.Errorf("got comment %q, expected %q", comment, expectedComment)
+	}
+
+	// The zip archive has the same entries.
+	var zipfile bytes.Buffer
+	if err := WriteZip(&zipfile, chain, commit, "repo-v2/"); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipfile.Bytes()), int64(zipfile.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zr.Comment != commit {
+		t.Errorf("got zip comment %q, expected %q", zr.Comment, commit)
+	}
+	if len(zr.File) != len(expected) {
+		t.Fatalf("got %d zip entries, expected %d", len(zr.File), len(expected))
+	}
+	for i, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := expected[i]
+		if e.Typeflag == tar.TypeSymlink {
+			e.Data = e.Linkname
+		}
+		if f.Name != e.Name || string(data) != e.Data || int64(f.Mode().Perm()) != e.Mode {
+			t.Errorf("got zip entry %s %v %q, expected %+v", f.Name, f.Mode(), data, e)
+		}
+	}
+}
+
+func TestMissingPath(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo.git")
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+	runGit(t, "-C", repo, "config", "uploadpack.allowFilter", "true")
+	u := archivedRepo(t, repo, &Options{Filter: "blob:limit=100"})
+
+	missing, err := MissingPath(u.Objects, u.Refs["HEAD"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing != "file" {
+		t.Errorf("got missing path %q, expected file", missing)
+	}
+}
@@ -0,0 +1,109 @@
+package git
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// dial connects to addr honoring the ConnectTimeout and IdleTimeout of opts.
+// The connection is closed as soon as ctx is done, so that any blocked
+// Read or Write returns.
+func dial(ctx context.Context, network, addr string, opts *Options) (net.Conn, error) {
+	d := &net.Dialer{Timeout: opts.ConnectTimeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	return &timeoutConn{Conn: conn, ctx: ctx, idle: opts.IdleTimeout}, nil
+}
+
+// timeoutConn is a net.Conn that fails a Read if no data arrives for idle,
+// and that reports the ctx error instead of the one caused by closing it.
+type timeoutConn struct {
+	net.Conn
+	ctx  context.Context
+	idle time.Duration
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.idle > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.idle))
+	}
+	n, err := c.Conn.Read(p)
+	if err != nil && err != io.EOF {
+		err = ctxErr(c.ctx, err)
+	}
+	return n, err
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	return n, ctxErr(c.ctx, err)
+}
+
+// ctxErr returns ctx.Err() if ctx is done, as that is the real reason of
+// err, and err otherwise.
+func ctxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// uploadPackError returns the error of a git-upload-pack that ran over ssh
+// or as a local process and exited with exitErr, as a RemoteError with its
+// stderr. If it exited successfully, or we killed it because ctx is done,
+// it returns nil.
+func uploadPackError(ctx context.Context, exitErr error, stderr string) error {
+	switch exitErr.(type) {
+	case *ssh.ExitError, *exec.ExitError:
+	default:
+		return nil
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	msg := strings.TrimSpace(stderr)
+	if msg == "" {
+		msg = "git-upload-pack: " + exitErr.Error()
+	}
+	return RemoteError{msg}
+}
+
+// httpClient returns a client that dials with dial, for use during a single
+// fetch. Its connections go away when ctx is done.
+func httpClient(ctx context.Context, opts *Options) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: func(network, addr string) (net.Conn, error) {
+				return dial(ctx, network, addr, opts)
+			},
+			TLSHandshakeTimeout:   opts.ConnectTimeout,
+			ResponseHeaderTimeout: opts.IdleTimeout,
+		},
+	}
+}
+
+// cancelCloser calls cancel after closing the ReadCloser.
+type cancelCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
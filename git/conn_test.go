@@ -0,0 +1,81 @@
+package git
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// stallingGitServer accepts git:// connections and never answers.
+func stallingGitServer(t *testing.T) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-done
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String(), func() {
+		close(done)
+		l.Close()
+	}
+}
+
+func TestFetchIdleTimeout(t *testing.T) {
+	addr, stop := stallingGitServer(t)
+	defer stop()
+
+	start := time.Now()
+	_, err := FetchWithOptions("git://"+addr+"/repo.git", nil, &Options{IdleTimeout: 100 * time.Millisecond})
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("took %s", time.Since(start))
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	addr, stop := stallingGitServer(t)
+	defer stop()
+
+	_, err := FetchWithOptions("git://"+addr+"/repo.git", nil, &Options{Timeout: 100 * time.Millisecond})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestFetchContextCancel(t *testing.T) {
+	addr, stop := stallingGitServer(t)
+	defer stop()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		w.Write([]byte("001e# service=git-upload-pack\n0000"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	for _, u := range []string{"git://" + addr + "/repo.git", srv.URL + "/repo.git"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		_, err := FetchContext(ctx, u, nil, nil)
+		if err != context.Canceled {
+			t.Errorf("%s: expected context.Canceled, got %v", u, err)
+		}
+	}
+}
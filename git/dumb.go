@@ -0,0 +1,361 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// https://github.com/git/git/blob/master/Documentation/technical/http-protocol.txt
+// (Dumb Clients)
+
+// isSmartAdvertisement reports whether a response to /info/refs comes from
+// a smart server. Like git, we tell by the Content-Type, since dumb
+// servers just serve the static file.
+func isSmartAdvertisement(resp *http.Response) bool {
+	return resp.Header.Get("Content-Type") == "application/x-git-upload-pack-advertisement"
+}
+
+// parseInfoRefs parses the info/refs file of a dumb server, with lines like
+// "<id>\trefs/heads/master".
+func parseInfoRefs(r io.Reader) (*Advertisement, error) {
+	adv := newAdvertisement(nil)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		parts := strings.Split(s.Text(), "\t")
+		if len(parts) != 2 || len(parts[0]) != 40 {
+			return nil, GitParseError{"info/refs"}
+		}
+		adv.Refs[parts[1]] = parts[0]
+	}
+	return adv, s.Err()
+}
+
+// dumbWalker downloads objects from a dumb HTTP server, where they are
+// either loose or in one of the packs listed in objects/info/packs.
+type dumbWalker struct {
+	ctx    context.Context
+	client *http.Client
+	gitURL string
+
+	// packs are listed the first time an object isn't found loose. Their
+	// packfile is only downloaded when we need one of their objects.
+	packs []*dumbPack
+}
+
+type dumbPack struct {
+	name string
+	idx  *PackIndex
+	file *os.File
+	pack *Pack
+}
+
+// get requests path relative to the repository. It returns a nil body if
+// the file is not there.
+func (w *dumbWalker) get(path string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", w.gitURL+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(w.ctx)
+	req.Header.Set("User-Agent", agent)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, ctxErr(w.ctx, err)
+	}
+	if resp.StatusCode == 404 {
+		resp.Body.Close()
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, HTTPError{"GET /" + path, resp.StatusCode}
+	}
+	return resp.Body, nil
+}
+
+// readLooseObject reads a loose object file, which is the zlib-compressed
+// "<type> <size>\x00<contents>".
+func readLooseObject(r io.Reader) (ObjectType, []byte, error) {
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := ioutil.ReadAll(z)
+	if err != nil {
+		return 0, nil, err
+	}
+	nul := bytes.IndexByte(data, 0)
+	if nul < 0 {
+		return 0, nil, GitParseError{"loose object"}
+	}
+	header := strings.Fields(string(data[:nul]))
+	data = data[nul+1:]
+	if len(header) != 2 || header[1] != strconv.Itoa(len(data)) {
+		return 0, nil, GitParseError{"loose object"}
+	}
+	for _, t := range []ObjectType{ObjCommit, ObjTree, ObjBlob, ObjTag} {
+		if t.String() == header[0] {
+			return t, data, nil
+		}
+	}
+	return 0, nil, GitParseError{"loose object"}
+}
+
+func (w *dumbWalker) ReadObject(id string) (ObjectType, []byte, error) {
+	body, err := w.get("objects/" + id[:2] + "/" + id[2:])
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		defer body.Close()
+		return readLooseObject(body)
+	}
+
+	if w.packs == nil {
+		if err := w.listPacks(); err != nil {
+			return 0, nil, err
+		}
+	}
+	for _, p := range w.packs {
+		if _, ok := p.idx.Lookup(id); !ok {
+			continue
+		}
+		if p.pack == nil {
+			if err := w.downloadPack(p); err != nil {
+				return 0, nil, err
+			}
+		}
+		return p.pack.ReadObject(id)
+	}
+	return 0, nil, ErrObjectNotFound
+}
+
+// listPacks reads objects/info/packs and the index of each pack.
+func (w *dumbWalker) listPacks() error {
+	w.packs = []*dumbPack{}
+	body, err := w.get("objects/info/packs")
+	if err != nil || body == nil {
+		return err
+	}
+	defer body.Close()
+	s := bufio.NewScanner(body)
+	for s.Scan() {
+		// P pack-<checksum>.pack
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 || fields[0] != "P" || !strings.HasSuffix(fields[1], ".pack") {
+			continue
+		}
+		p := &dumbPack{name: strings.TrimSuffix(fields[1], ".pack")}
+		idx, err := w.get("objects/pack/" + p.name + ".idx")
+		if err != nil {
+			return err
+		}
+		if idx == nil {
+			return fmt.Errorf("missing index for %s", fields[1])
+		}
+		p.idx, err = ReadPackIndex(idx)
+		idx.Close()
+		if err != nil {
+			return fmt.Errorf("%s.idx: %v", p.name, err)
+		}
+		w.packs = append(w.packs, p)
+	}
+	return s.Err()
+}
+
+// downloadPack downloads a whole packfile to a temporary file.
+func (w *dumbWalker) downloadPack(p *dumbPack) error {
+	body, err := w.get("objects/pack/" + p.name + ".pack")
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return fmt.Errorf("missing %s.pack", p.name)
+	}
+	defer body.Close()
+	f, err := ioutil.TempFile("", "gitarchive-dumb")
+	if err != nil {
+		return err
+	}
+	p.file = f
+	if _, err := io.Copy(f, body); err != nil {
+		return ctxErr(w.ctx, err)
+	}
+	p.pack = NewPack(f, p.idx, nil)
+	return nil
+}
+
+func (w *dumbWalker) close() {
+	for _, p := range w.packs {
+		if p.file != nil {
+			p.file.Close()
+			os.Remove(p.file.Name())
+		}
+	}
+}
+
+// objectIDRe matches a full object ID.
+var objectIDRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// objectLinks returns the objects an object points to, leaving out
+// submodules and haves.
+func objectLinks(t ObjectType, data []byte, haves map[string]struct{}) ([]string, error) {
+	var res []string
+	switch t {
+	case ObjCommit, ObjTag:
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == "" {
+				// End of the headers.
+				break
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			switch fields[0] {
+			case "tree", "parent", "object":
+				// The IDs end up in paths and URLs, so don't trust them.
+				if !objectIDRe.MatchString(fields[1]) {
+					return nil, GitParseError{fields[0] + " line"}
+				}
+				res = append(res, fields[1])
+			}
+		}
+	case ObjTree:
+		entries, err := ParseTree(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Mode != ModeSubmodule {
+				res = append(res, e.ID)
+			}
+		}
+	}
+	links := res[:0]
+	for _, id := range res {
+		if _, ok := haves[id]; !ok {
+			links = append(links, id)
+		}
+	}
+	return links, nil
+}
+
+// tempPack is a packfile in a temporary file, removed on Close.
+type tempPack struct {
+	io.Reader
+	f *os.File
+}
+
+func (p *tempPack) Close() error {
+	err := p.f.Close()
+	os.Remove(p.f.Name())
+	return err
+}
+
+// fetchDumbHTTP fetches from a dumb server. It walks the history from the
+// wants down to the haves, downloading every object along the way, and
+// puts them in a single packfile. Since the server can't tell which trees
+// and blobs we already have, all the ones of the new commits are included.
+func fetchDumbHTTP(ctx context.Context, client *http.Client, gitURL string, infoRefs io.Reader,
+	haves map[string]struct{}, opts *Options) (*Result, error) {
+
+	if opts.deepen() {
+		return nil, UnsupportedError{"shallow"}
+	}
+	if opts.Filter != "" {
+		return nil, UnsupportedError{"filter"}
+	}
+
+	adv, err := parseInfoRefs(infoRefs)
+	if err != nil {
+		return nil, err
+	}
+	w := &dumbWalker{ctx: ctx, client: client, gitURL: gitURL}
+	defer w.close()
+	if head, err := w.get("HEAD"); err != nil {
+		return nil, err
+	} else if head != nil {
+		data, err := ioutil.ReadAll(head)
+		head.Close()
+		if err != nil {
+			return nil, ctxErr(ctx, err)
+		}
+		target := strings.TrimSpace(strings.TrimPrefix(string(data), "ref:"))
+		if id, ok := adv.Refs[target]; ok {
+			adv.Symrefs["HEAD"] = target
+			adv.Refs["HEAD"] = id
+		}
+	}
+	res := newResult(adv, 0, opts)
+	res.noSideBand = true
+
+	wants := selectWants(res.Refs, haves)
+	if len(wants) == 0 {
+		return res, nil
+	}
+
+	f, err := ioutil.TempFile("", "gitarchive-dumb")
+	if err != nil {
+		return nil, err
+	}
+	pack := &tempPack{f: f}
+	body := bufio.NewWriter(f)
+	var count uint32
+	seen := make(map[string]bool)
+	for len(wants) > 0 {
+		id := wants[len(wants)-1]
+		wants = wants[:len(wants)-1]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		t, data, err := w.ReadObject(id)
+		if err == ErrObjectNotFound {
+			err = fmt.Errorf("object %s not found on the server", id)
+		}
+		if err == nil && HashObject(t, data) != id {
+			err = fmt.Errorf("object %s is corrupted", id)
+		}
+		if err != nil {
+			pack.Close()
+			return nil, err
+		}
+		if err := writePackObject(body, t, data); err != nil {
+			pack.Close()
+			return nil, err
+		}
+		count++
+
+		links, err := objectLinks(t, data, haves)
+		if err != nil {
+			pack.Close()
+			return nil, err
+		}
+		wants = append(wants, links...)
+	}
+	if err := body.Flush(); err != nil {
+		pack.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		pack.Close()
+		return nil, err
+	}
+
+	pack.Reader = newPackStream(count, bufio.NewReader(f))
+	res.Pack = pack
+	return res, nil
+}
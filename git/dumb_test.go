@@ -0,0 +1,113 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fetchObjects fetches from gitURL and returns the IDs of the objects in
+// the packfile, sorted.
+func fetchObjects(t *testing.T, gitURL string, haves map[string]struct{}) (*Result, []string) {
+	res, err := FetchWithOptions(gitURL, haves, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Pack == nil {
+		return res, nil
+	}
+	pack, err := ioutil.ReadAll(res.Pack)
+	res.Pack.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := IndexPack(bytes.NewReader(pack), int64(len(pack)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range idx.Entries {
+		ids = append(ids, e.ID)
+	}
+	return res, ids
+}
+
+// revListObjects returns the IDs of the objects of revs, sorted.
+func revListObjects(t *testing.T, repo string, revs ...string) []string {
+	var ids []string
+	args := append([]string{"-C", repo, "rev-list", "--objects"}, revs...)
+	for _, line := range strings.Split(runGit(t, args...), "\n") {
+		ids = append(ids, strings.Fields(line)[0])
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestFetchDumbHTTP(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo.git")
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+	runGit(t, "-C", repo, "update-server-info")
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	// All the objects are loose.
+	res, ids := fetchObjects(t, srv.URL+"/repo.git", nil)
+	if res.Head() != "refs/heads/master" || res.Refs["HEAD"] != res.Refs["refs/heads/master"] {
+		t.Errorf("got HEAD %q, refs %v", res.Head(), res.Refs)
+	}
+	if res.Refs["refs/tags/v1^{}"] == "" || res.Refs["refs/pull/1/head"] != "" {
+		t.Errorf("got refs %v", res.Refs)
+	}
+	if expected := revListObjects(t, repo, "--all"); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("got objects %v, expected %v", ids, expected)
+	}
+
+	// Now they are packed, except for a new commit.
+	haves := map[string]struct{}{res.Refs["refs/heads/master"]: {}, res.Refs["refs/tags/v1"]: {}}
+	runGit(t, "-C", repo, "repack", "-q", "-a", "-d")
+	if err := ioutil.WriteFile(filepath.Join(work, "new"), []byte("new file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, "-C", work, "add", "new")
+	runGit(t, "-C", work, "commit", "-q", "-m", "new")
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+	runGit(t, "-C", repo, "update-server-info")
+
+	// We get the new commit with its whole tree, since the server can't
+	// tell what we have.
+	_, ids = fetchObjects(t, srv.URL+"/repo.git", haves)
+	expected := []string{runGit(t, "-C", repo, "rev-parse", "master"), runGit(t, "-C", repo, "rev-parse", "master^{tree}")}
+	for _, line := range strings.Split(runGit(t, "-C", repo, "ls-tree", "-r", "-t", "master"), "\n") {
+		expected = append(expected, strings.Fields(line)[2])
+	}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("got objects %v, expected %v", ids, expected)
+	}
+
+	if _, err := FetchWithOptions(srv.URL+"/repo.git", nil, &Options{Depth: 1}); err == nil {
+		t.Error("made a shallow fetch from a dumb server")
+	} else if _, ok := err.(UnsupportedError); !ok {
+		t.Errorf("expected an UnsupportedError, got %v", err)
+	}
+}
+
+func TestObjectLinksBadID(t *testing.T) {
+	for _, id := range []string{"../../../etc/passwd", "a", strings.Repeat("A", 40)} {
+		commit := "tree " + strings.Repeat("a", 40) + "\nparent " + id + "\n\nmessage\n"
+		if _, err := objectLinks(ObjCommit, []byte(commit), nil); err == nil {
+			t.Errorf("accepted parent %q", id)
+		} else if _, ok := err.(GitParseError); !ok {
+			t.Errorf("expected a GitParseError for %q, got %v", id, err)
+		}
+	}
+}
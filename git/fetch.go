@@ -6,16 +6,135 @@ import (
 	"expvar"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"sort"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
 )
 
+const agent = "github.com/thecodearchive/gitarchive/git"
+
+// Options tunes FetchWithOptions. The zero value is equivalent to Fetch.
+type Options struct {
+	// MsgW receives the sideband messages from the git server. If nil,
+	// they are discarded.
+	MsgW io.Writer
+
+	// Progress, if not nil, is called with the progress of the server
+	// while it prepares the packfile, and of its download as it's read.
+	Progress func(Progress)
+
+	// BWCounter, if not nil, is incremented with the number of bytes
+	// fetched as they are read.
+	BWCounter *expvar.Int
+
+	// ProtocolVersion is the git wire protocol version to ask for, 0 or 2.
+	// If the server doesn't speak protocol v2 the fetch falls back to v0.
+	ProtocolVersion int
+
+	// ConnectTimeout bounds the time it takes to connect to the server.
+	ConnectTimeout time.Duration
+
+	// IdleTimeout bounds the time any read from the server can block,
+	// both during the negotiation and while reading the packfile.
+	IdleTimeout time.Duration
+
+	// Timeout bounds the whole fetch, including reading Pack until the end.
+	Timeout time.Duration
+
+	// RefFilter selects the refs to fetch. If nil, DefaultRefFilter is
+	// used.
+	RefFilter *RefFilter
+
+	// RefPrefixes restricts the refs requested with protocol v2 ls-refs.
+	// If nil, it's derived from RefFilter. It is ignored with protocol v0.
+	RefPrefixes []string
+
+	// Depth, DeepenSince and DeepenNot make a shallow fetch, limited to
+	// Depth commits from the tips, to commits newer than DeepenSince, or
+	// to commits not reachable from the DeepenNot refs, respectively.
+	Depth       int
+	DeepenSince time.Time
+	DeepenNot   []string
+
+	// Shallows are the shallow boundary commits left by previous shallow
+	// fetches. They tell the server that we don't have their parents.
+	Shallows []string
+
+	// HaveDates are the commit dates of the haves, if known. The haves are
+	// sent newest first, which makes finding the common history faster.
+	HaveDates map[string]time.Time
+
+	// Filter makes a partial fetch, leaving out some objects. For example,
+	// "blob:limit=1m" omits the blobs over 1MB, and "tree:0" all the trees
+	// and blobs. The server must support it, or the fetch fails with an
+	// UnsupportedError.
+	Filter string
+
+	// SSHSigners are the keys used to authenticate to ssh servers, along
+	// with the ones loaded from the SSHKeyFiles, which are unencrypted
+	// private keys in PEM or OpenSSH format.
+	SSHSigners  []ssh.Signer
+	SSHKeyFiles []string
+
+	// KnownHostsFile is the known_hosts file the ssh server keys are
+	// checked against. If empty, ~/.ssh/known_hosts is used, unless
+	// HostKeyCallback is set, in which case it does the checking instead.
+	KnownHostsFile  string
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+// Result is what FetchWithOptions returns.
+type Result struct {
+	// Refs are the refs we archive, which are the Advertisement.Refs
+	// that pass Options.RefFilter.
+	Refs map[string]string
+
+	// Advertisement is what the server told us about itself and its refs.
+	Advertisement *Advertisement
+
+	// Pack is the packfile stream, or nil if there were no new objects.
+	Pack io.ReadCloser
+
+	// ProtocolVersion is the protocol version that was actually spoken.
+	ProtocolVersion int
+
+	// HavesSent is the number of haves sent during the negotiation.
+	HavesSent int
+
+	// Shallow are the commits the server made shallow boundaries in this
+	// fetch, and Unshallow the Options.Shallows that aren't anymore.
+	Shallow, Unshallow []string
+
+	// noSideBand is set if the server doesn't multiplex the packfile.
+	noSideBand bool
+}
+
+// Head returns the ref HEAD pointed to, like "refs/heads/master", or ""
+// if the server didn't tell.
+func (r *Result) Head() string {
+	if r.Advertisement == nil {
+		return ""
+	}
+	return r.Advertisement.Symrefs["HEAD"]
+}
+
+func newResult(adv *Advertisement, version int, opts *Options) *Result {
+	refs := opts.refFilter().Filter(adv.Refs)
+	return &Result{Refs: refs, Advertisement: adv, ProtocolVersion: version}
+}
+
 // Fetch fetches the git repo at gitURL and the returns the refs.
 //
-// It supports git:// and http(s):// URLs.
+// It supports git://, http(s)://, ssh:// and file:// URLs, scp-like ones
+// such as "git@github.com:user/repo.git", which are fetched over ssh, and
+// local paths.
 //
 // Sideband messages from the git server are writetn to msgW, and the
 // number of bytes fetched is incremented in bwCounter. bwCounter is
@@ -23,31 +142,93 @@ import (
 func Fetch(gitURL string, haves map[string]struct{}, msgW io.Writer,
 	bwCounter *expvar.Int) (refs map[string]string, r io.ReadCloser, err error) {
 
-	u, err := url.Parse(gitURL)
+	res, err := FetchWithOptions(gitURL, haves, &Options{MsgW: msgW, BWCounter: bwCounter})
 	if err != nil {
 		return nil, nil, err
 	}
+	return res.Refs, res.Pack, nil
+}
 
-	switch u.Scheme {
+// FetchWithOptions is like Fetch, but takes its settings from opts, which
+// can be nil.
+func FetchWithOptions(gitURL string, haves map[string]struct{}, opts *Options) (*Result, error) {
+	return FetchContext(context.Background(), gitURL, haves, opts)
+}
+
+// FetchContext is like FetchWithOptions, but the fetch is aborted as soon
+// as ctx is done, including while the caller is reading Pack.
+func FetchContext(ctx context.Context, gitURL string, haves map[string]struct{}, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.ProtocolVersion != 0 && opts.ProtocolVersion != 2 {
+		return nil, fmt.Errorf("unsupported protocol version %d", opts.ProtocolVersion)
+	}
+
+	scheme := "ssh"
+	if !isSCPLike(gitURL) {
+		u, err := url.Parse(gitURL)
+		if err != nil {
+			return nil, err
+		}
+		scheme = u.Scheme
+	}
+
+	var cancel context.CancelFunc
+	if opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	var res *Result
+	var err error
+	switch scheme {
 	case "http", "https":
-		refs, r, err = fetchHTTP(gitURL, haves)
+		res, err = fetchHTTP(ctx, gitURL, haves, opts)
 	case "git":
-		refs, r, err = fetchGIT(gitURL, haves)
+		res, err = fetchGIT(ctx, gitURL, haves, opts)
+	case "ssh", "git+ssh", "ssh+git":
+		res, err = fetchSSH(ctx, gitURL, haves, opts)
+	case "file", "":
+		res, err = fetchLocal(ctx, gitURL, haves, opts)
 	default:
-		return nil, nil, errors.New("unsupported Scheme " + u.Scheme)
+		err = errors.New("unsupported Scheme " + scheme)
 	}
 
 	if err != nil {
-		return nil, nil, err
+		cancel()
+		return nil, err
 	}
 
-	if r == nil {
+	if res.Pack == nil {
 		// We came up with no wants. We already have all the objects.
-		return refs, nil, nil
+		cancel()
+		return res, nil
 	}
 
-	sbr := &sideBandReader{Upstream: r, MsgW: msgW}
-	cr := &countingReader{Upstream: sbr, Counter: bwCounter}
+	// Closing r also releases ctx, stopping the Timeout.
+	r := cancelCloser{ReadCloser: res.Pack, cancel: cancel}
+	var pr io.Reader = r
+	var progress *progressTracker
+	if opts.Progress != nil {
+		progress = newProgressTracker(opts.Progress)
+	}
+	if !res.noSideBand {
+		// Without side-band the packfile follows the final ACK/NAK as is.
+		msgW := opts.MsgW
+		if msgW == nil {
+			msgW = ioutil.Discard
+		}
+		if progress != nil {
+			msgW = io.MultiWriter(progress, msgW)
+		}
+		pr = &sideBandReader{Upstream: r, MsgW: msgW, StopAtFlush: res.ProtocolVersion == 2}
+	}
+	if progress != nil {
+		pr = progress.reader(pr)
+	}
+	cr := &countingReader{Upstream: pr, Counter: opts.BWCounter}
 
 	// Peek into the first 32 bytes to make sure it's not an empty
 	// packfile.
@@ -56,27 +237,28 @@ func Fetch(gitURL string, haves map[string]struct{}, msgW io.Writer,
 	n, err := io.CopyN(&buf, cr, 64)
 	if err != io.EOF && err != nil {
 		r.Close()
-		return nil, nil, err
+		return nil, err
 	}
 	if n == 32 {
 		r.Close()
-		return refs, nil, nil
+		res.Pack = nil
+		return res, nil
 	}
 	if n < 32 {
 		r.Close()
-		return nil, nil, io.ErrUnexpectedEOF
+		return nil, io.ErrUnexpectedEOF
 	}
-	rc := struct {
+	res.Pack = struct {
 		io.Reader
 		io.Closer
 	}{
 		Reader: io.MultiReader(&buf, cr),
 		Closer: r,
 	}
-	return refs, rc, nil
+	return res, nil
 }
 
-func fetchGIT(gitURL string, haves map[string]struct{}) (refs map[string]string, r io.ReadCloser, err error) {
+func fetchGIT(ctx context.Context, gitURL string, haves map[string]struct{}, opts *Options) (*Result, error) {
 	u, _ := url.Parse(gitURL)
 	port := "9418"
 	host := u.Host
@@ -85,41 +267,103 @@ func fetchGIT(gitURL string, haves map[string]struct{}) (refs map[string]string,
 		host = h
 	}
 
-	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	conn, err := dial(ctx, "tcp", net.JoinHostPort(host, port), opts)
 	if err != nil {
-		return
+		return nil, err
 	}
 	command := "git-upload-pack " + u.Path + "\x00host=" + host + "\x00"
+	if opts.ProtocolVersion == 2 {
+		command += "\x00version=2\x00"
+	}
 	conn.Write([]byte(fmt.Sprintf("%04x%s", len(command)+4, command)))
+	return fetchStream(conn, haves, opts)
+}
 
-	refs, err = ParseSmartResponse(conn, true)
+// fetchStream fetches over a stateful connection to git-upload-pack, like a
+// git:// one or an ssh session, once the command is sent. conn is closed on
+// error, or if there is no packfile.
+func fetchStream(conn io.ReadWriteCloser, haves map[string]struct{}, opts *Options) (*Result, error) {
+	v2, r, err := detectVersion2(conn)
 	if err != nil {
 		conn.Close()
-		return
+		return nil, err
+	}
+	if v2 {
+		res, err := fetchStreamV2(conn, r, haves, opts)
+		if err != nil || res.Pack == nil {
+			conn.Close()
+		}
+		return res, err
 	}
 
-	resp := buildResponse(refs, haves)
-	if resp == nil {
+	adv, err := ParseSmartResponse(r, true)
+	if err != nil {
 		conn.Close()
-		return
+		return nil, err
 	}
+	res := newResult(adv, 0, opts)
 
-	_, err = io.Copy(conn, resp)
+	wants := selectWants(res.Refs, haves)
+	if len(wants) == 0 {
+		conn.Close()
+		return res, nil
+	}
+	req, err := buildWants(wants, adv.Capabilities, opts)
 	if err != nil {
 		conn.Close()
-		return
+		return nil, err
 	}
 
-	return refs, conn, nil
+	n := newNegotiation(haves, opts, adv.Capabilities.Has("multi_ack_detailed"), adv.Capabilities.Has("no-done"))
+	send := func(req *bytes.Buffer) (io.Reader, error) {
+		_, err := io.Copy(conn, req)
+		return conn, err
+	}
+	if err := negotiateV0(send, req, n, opts, res, false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	res.Pack = conn
+	res.noSideBand = !adv.Capabilities.Has("side-band-64k") && !adv.Capabilities.Has("side-band")
+	return res, nil
 }
 
-func buildResponse(refs map[string]string, haves map[string]struct{}) *bytes.Buffer {
-	for name := range refs {
-		if strings.HasPrefix(name, "refs/pull/") {
-			delete(refs, name)
-		}
+func fetchStreamV2(conn io.ReadWriteCloser, r io.Reader, haves map[string]struct{}, opts *Options) (*Result, error) {
+	caps, err := parseCapabilitiesV2(r)
+	if err != nil {
+		return nil, err
 	}
 
+	if _, err := io.Copy(conn, buildLsRefsRequest(caps, opts.refPrefixes())); err != nil {
+		return nil, err
+	}
+	adv, err := parseLsRefs(conn, caps)
+	if err != nil {
+		return nil, err
+	}
+	res := newResult(adv, 2, opts)
+
+	wants := selectWants(res.Refs, haves)
+	if len(wants) == 0 {
+		return res, nil
+	}
+
+	n := newNegotiation(haves, opts, true, false)
+	send := func(req *bytes.Buffer) (io.Reader, error) {
+		_, err := io.Copy(conn, req)
+		return conn, err
+	}
+	if err := negotiateV2(send, caps, wants, n, opts, res); err != nil {
+		return nil, err
+	}
+
+	res.Pack = conn
+	return res, nil
+}
+
+// selectWants returns the sorted, deduplicated objects we need to ask for.
+func selectWants(refs map[string]string, haves map[string]struct{}) []string {
 	var wants []string
 	for name, ref := range refs {
 		if _, ok := haves[ref]; ok {
@@ -132,76 +376,221 @@ func buildResponse(refs map[string]string, haves map[string]struct{}) *bytes.Buf
 	}
 	sort.Strings(wants)
 
-	if len(wants) == 0 {
-		return nil
-	}
-
-	resp := &bytes.Buffer{}
-	last := ""
+	var res []string
 	for _, want := range wants {
-		if last == want {
+		if len(res) > 0 && res[len(res)-1] == want {
 			continue
 		}
-		command := "want " + want
-		if last == "" {
-			command += " ofs-delta side-band-64k thin-pack"
-			command += " agent=github.com/thecodearchive/gitarchive/git"
+		res = append(res, want)
+	}
+	return res
+}
+
+// wantCapabilities are the capabilities we ask for, if the server has them.
+var wantCapabilities = []string{"multi_ack_detailed", "no-done", "ofs-delta", "side-band-64k", "thin-pack"}
+
+// buildWants builds the first part of a protocol v0 request, up to the
+// flush-pkt that precedes the haves.
+func buildWants(wants []string, caps Capabilities, opts *Options) (*bytes.Buffer, error) {
+	want, err := shallowCapabilities(caps, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Filter != "" {
+		if !caps.Has("filter") {
+			return nil, UnsupportedError{"filter"}
+		}
+		want = append(want, "filter")
+	}
+	for _, c := range wantCapabilities {
+		if caps.Has(c) {
+			want = append(want, c)
 		}
-		command += "\n"
-		resp.WriteString(fmt.Sprintf("%04x%s", len(command)+4, command))
-		last = want
 	}
-	resp.WriteString("0000")
-	for have := range haves { // TODO: sort the haves
-		command := "have " + have + "\n"
-		resp.WriteString(fmt.Sprintf("%04x%s", len(command)+4, command))
+	if !caps.Has("side-band-64k") && caps.Has("side-band") {
+		want = append(want, "side-band")
+	}
+	if caps.Has("agent") {
+		want = append(want, "agent="+agent)
 	}
-	resp.WriteString("0009done\n")
 
-	return resp
+	resp := &bytes.Buffer{}
+	for i, w := range wants {
+		command := "want " + w
+		if i == 0 && len(want) > 0 {
+			command += " " + strings.Join(want, " ")
+		}
+		writePktLine(resp, command+"\n")
+	}
+	writeShallow(resp, opts)
+	writeFilter(resp, opts)
+	resp.WriteString("0000")
+	return resp, nil
 }
 
-func fetchHTTP(gitURL string, haves map[string]struct{}) (refs map[string]string, r io.ReadCloser, err error) {
+// writeFilter writes the filter line of a request, if any. It's the same in
+// protocol v0 and v2.
+func writeFilter(w *bytes.Buffer, opts *Options) {
+	if opts.Filter != "" {
+		writePktLine(w, "filter "+opts.Filter+"\n")
+	}
+}
+
+func fetchHTTP(ctx context.Context, gitURL string, haves map[string]struct{}, opts *Options) (*Result, error) {
+	client := httpClient(ctx, opts)
 	req, err := http.NewRequest("GET", gitURL+"/info/refs?service=git-upload-pack", nil)
 	if err != nil {
-		return
+		return nil, err
 	}
-	req.Header.Set("User-Agent", "github.com/thecodearchive/gitarchive/git")
-	resp, err := http.DefaultClient.Do(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", agent)
+	if opts.ProtocolVersion == 2 {
+		req.Header.Set("Git-Protocol", "version=2")
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return
+		return nil, ctxErr(ctx, err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == 401 || resp.StatusCode == 404 {
-		return nil, nil, RemoteError{resp.Status}
+		return nil, RemoteError{resp.Status}
 	}
 	if resp.StatusCode != 200 {
-		return nil, nil, fmt.Errorf("GET /info/refs: %d", resp.StatusCode)
+		return nil, HTTPError{"GET /info/refs", resp.StatusCode}
+	}
+	if !isSmartAdvertisement(resp) {
+		return fetchDumbHTTP(ctx, client, gitURL, resp.Body, haves, opts)
+	}
+
+	v2, r, err := detectVersion2(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if v2 {
+		return fetchHTTPv2(ctx, client, gitURL, r, haves, opts)
+	}
+
+	adv, err := ParseSmartResponse(r, false)
+	if err != nil {
+		return nil, err
+	}
+	res := newResult(adv, 0, opts)
+
+	wants := selectWants(res.Refs, haves)
+	if len(wants) == 0 {
+		return res, nil
 	}
-	refs, err = ParseSmartResponse(resp.Body, false)
+	body, err := buildWants(wants, adv.Capabilities, opts)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	body := buildResponse(refs, haves)
-	if body == nil {
-		return
+	n := newNegotiation(haves, opts, adv.Capabilities.Has("multi_ack_detailed"), adv.Capabilities.Has("no-done"))
+	rounds := &httpRounds{ctx: ctx, client: client, gitURL: gitURL}
+	if err := negotiateV0(rounds.send, body, n, opts, res, true); err != nil {
+		rounds.close()
+		return nil, err
 	}
 
-	req, err = http.NewRequest("POST", gitURL+"/git-upload-pack", body)
+	res.Pack = rounds.body
+	res.noSideBand = !adv.Capabilities.Has("side-band-64k") && !adv.Capabilities.Has("side-band")
+	return res, nil
+}
+
+func fetchHTTPv2(ctx context.Context, client *http.Client, gitURL string, r io.Reader, haves map[string]struct{}, opts *Options) (*Result, error) {
+	caps, err := parseCapabilitiesV2(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := postUploadPack(ctx, client, gitURL, buildLsRefsRequest(caps, opts.refPrefixes()), true)
+	if err != nil {
+		return nil, err
+	}
+	adv, err := parseLsRefs(resp.Body, caps)
+	resp.Body.Close()
 	if err != nil {
-		return
+		return nil, err
 	}
+	res := newResult(adv, 2, opts)
+
+	wants := selectWants(res.Refs, haves)
+	if len(wants) == 0 {
+		return res, nil
+	}
+
+	n := newNegotiation(haves, opts, true, false)
+	rounds := &httpRounds{ctx: ctx, client: client, gitURL: gitURL, v2: true}
+	if err := negotiateV2(rounds.send, caps, wants, n, opts, res); err != nil {
+		rounds.close()
+		return nil, err
+	}
+
+	res.Pack = rounds.body
+	return res, nil
+}
+
+// httpRounds sends negotiation rounds as POST requests, keeping the body
+// of the last response open.
+type httpRounds struct {
+	ctx    context.Context
+	client *http.Client
+	gitURL string
+	v2     bool
+
+	body io.ReadCloser
+}
+
+func (h *httpRounds) send(req *bytes.Buffer) (io.Reader, error) {
+	h.close()
+	resp, err := postUploadPack(h.ctx, h.client, h.gitURL, req, h.v2)
+	if err != nil {
+		return nil, err
+	}
+	h.body = resp.Body
+	return h.body, nil
+}
+
+func (h *httpRounds) close() {
+	if h.body != nil {
+		h.body.Close()
+		h.body = nil
+	}
+}
+
+func postUploadPack(ctx context.Context, client *http.Client, gitURL string, body io.Reader, v2 bool) (*http.Response, error) {
+	req, err := http.NewRequest("POST", gitURL+"/git-upload-pack", body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
 	req.Header.Set("Accept", "application/x-git-upload-pack-result")
-	req.Header.Set("User-Agent", "github.com/thecodearchive/gitarchive/git")
-	resp, err = http.DefaultClient.Do(req)
+	req.Header.Set("User-Agent", agent)
+	if v2 {
+		req.Header.Set("Git-Protocol", "version=2")
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return
+		return nil, ctxErr(ctx, err)
 	}
 	if resp.StatusCode != 200 {
-		return nil, nil, fmt.Errorf("POST /git-upload-pack: %d", resp.StatusCode)
+		resp.Body.Close()
+		return nil, HTTPError{"POST /git-upload-pack", resp.StatusCode}
+	}
+	return resp, nil
+}
+
+func (o *Options) refFilter() *RefFilter {
+	if o.RefFilter == nil {
+		return DefaultRefFilter
 	}
+	return o.RefFilter
+}
 
-	return refs, resp.Body, nil
+func (o *Options) refPrefixes() []string {
+	if o.RefPrefixes == nil {
+		return o.refFilter().prefixes()
+	}
+	return o.RefPrefixes
 }
@@ -0,0 +1,262 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestRepo creates a bare repository with a couple of commits, an
+// annotated tag and a pull request ref, and returns its parent directory.
+func newTestRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found, skipping")
+	}
+	dir, err := ioutil.TempDir("", "gitarchive-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := filepath.Join(dir, "work")
+	for _, args := range [][]string{
+		{"init", "-q", work},
+		{"-C", work, "commit", "-q", "--allow-empty", "-m", "first"},
+		{"-C", work, "tag", "-a", "-m", "v1", "v1"},
+		{"-C", work, "commit", "-q", "--allow-empty", "-m", "second"},
+		{"-C", work, "update-ref", "refs/pull/1/head", "HEAD~1"},
+		{"clone", "-q", "--mirror", work, filepath.Join(dir, "repo.git")},
+	} {
+		runGit(t, args...)
+	}
+	return dir
+}
+
+func runGit(t *testing.T, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newHTTPBackend serves the repositories in root over smart HTTP. If v0Only
+// is set, the Git-Protocol header is dropped, like an old server would.
+func newHTTPBackend(t *testing.T, root string, v0Only bool) *httptest.Server {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found, skipping")
+	}
+	h := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v0Only {
+			r.Header.Del("Git-Protocol")
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+// checkPack runs the fetched pack through git index-pack.
+func checkPack(t *testing.T, dir string, pack []byte) {
+	out := filepath.Join(dir, "check.git")
+	runGit(t, "init", "-q", "--bare", out)
+	cmd := exec.Command("git", "-C", out, "index-pack", "--stdin")
+	cmd.Stdin = bytes.NewReader(pack)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("index-pack: %v\n%s", err, out)
+	}
+	os.RemoveAll(out)
+}
+
+func TestFetchHTTPProtocolVersions(t *testing.T) {
+	dir := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	srv := newHTTPBackend(t, dir, false)
+	defer srv.Close()
+	head := runGit(t, "-C", filepath.Join(dir, "repo.git"), "symbolic-ref", "HEAD")
+
+	var results []*Result
+	for _, version := range []int{0, 2} {
+		res, err := FetchWithOptions(srv.URL+"/repo.git", nil, &Options{ProtocolVersion: version})
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if res.ProtocolVersion != version {
+			t.Errorf("v%d: spoke protocol v%d", version, res.ProtocolVersion)
+		}
+		if _, ok := res.Refs["refs/pull/1/head"]; ok {
+			t.Errorf("v%d: got a pull request ref", version)
+		}
+		if res.Head() != head {
+			t.Errorf("v%d: HEAD points to %q, expected %q", version, res.Head(), head)
+		}
+		if res.Pack == nil {
+			t.Fatalf("v%d: no packfile", version)
+		}
+		pack, err := ioutil.ReadAll(res.Pack)
+		res.Pack.Close()
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		checkPack(t, dir, pack)
+		results = append(results, res)
+	}
+
+	if !reflect.DeepEqual(results[0].Refs, results[1].Refs) {
+		t.Errorf("v0 and v2 refs differ: %v, %v", results[0].Refs, results[1].Refs)
+	}
+	if results[1].Refs["refs/tags/v1^{}"] == "" {
+		t.Errorf("v2 refs lack the peeled tag: %v", results[1].Refs)
+	}
+
+	haves := make(map[string]struct{})
+	for _, ref := range results[1].Refs {
+		haves[ref] = struct{}{}
+	}
+	res, err := FetchWithOptions(srv.URL+"/repo.git", haves, &Options{ProtocolVersion: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Pack != nil {
+		t.Error("got a packfile with nothing to fetch")
+	}
+}
+
+func TestFetchHTTPVersion2Fallback(t *testing.T) {
+	dir := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	srv := newHTTPBackend(t, dir, true)
+	defer srv.Close()
+
+	res, err := FetchWithOptions(srv.URL+"/repo.git", nil, &Options{ProtocolVersion: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ProtocolVersion != 0 {
+		t.Errorf("spoke protocol v%d", res.ProtocolVersion)
+	}
+	if res.Pack == nil {
+		t.Fatal("no packfile")
+	}
+	res.Pack.Close()
+}
+
+func TestFetchHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	_, err := FetchWithOptions(srv.URL+"/repo.git", nil, &Options{ProtocolVersion: 2})
+	expected := HTTPError{"GET /info/refs", http.StatusServiceUnavailable}
+	if err != expected {
+		t.Errorf("got error %#v, expected %#v", err, expected)
+	}
+}
+
+func TestFetchShallow(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	runGit(t, "-C", work, "push", "-q", filepath.Join(dir, "repo.git"), "master")
+	srv := newHTTPBackend(t, dir, false)
+	defer srv.Close()
+	tip := runGit(t, "-C", work, "rev-parse", "master")
+
+	for _, version := range []int{0, 2} {
+		res, err := FetchWithOptions(srv.URL+"/repo.git", nil, &Options{ProtocolVersion: version, Depth: 1})
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if res.Pack == nil {
+			t.Fatalf("v%d: no packfile", version)
+		}
+		stats, err := VerifyPack(res.Pack)
+		res.Pack.Close()
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		// One commit for master, and one for the v1 tag.
+		if stats.Types[ObjCommit] != 2 {
+			t.Errorf("v%d: got %d commits", version, stats.Types[ObjCommit])
+		}
+		if !contains(res.Shallow, tip) {
+			t.Errorf("v%d: master is not in the shallow list %v", version, res.Shallow)
+		}
+
+		// Deepening the same tips unshallows the boundary.
+		res, err = FetchWithOptions(srv.URL+"/repo.git", nil, &Options{
+			ProtocolVersion: version, Depth: 3, Shallows: res.Shallow})
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if res.Pack != nil {
+			res.Pack.Close()
+		}
+		if !contains(res.Unshallow, tip) {
+			t.Errorf("v%d: master is not in the unshallow list %v", version, res.Unshallow)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFetchFilter(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo.git")
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+	srv := newHTTPBackend(t, dir, false)
+	defer srv.Close()
+
+	for _, version := range []int{0, 2} {
+		runGit(t, "-C", repo, "config", "uploadpack.allowFilter", "false")
+		_, err := FetchWithOptions(srv.URL+"/repo.git", nil, &Options{ProtocolVersion: version, Filter: "tree:0"})
+		if err != (UnsupportedError{"filter"}) {
+			t.Errorf("v%d: expected an UnsupportedError, got %v", version, err)
+		}
+
+		runGit(t, "-C", repo, "config", "uploadpack.allowFilter", "true")
+		for filter, types := range map[string][]ObjectType{
+			"blob:limit=100": {ObjBlob},
+			"tree:0":         {ObjBlob, ObjTree},
+		} {
+			res, err := FetchWithOptions(srv.URL+"/repo.git", nil, &Options{ProtocolVersion: version, Filter: filter})
+			if err != nil {
+				t.Fatalf("v%d %s: %v", version, filter, err)
+			}
+			stats, err := VerifyPack(res.Pack)
+			res.Pack.Close()
+			if err != nil {
+				t.Fatalf("v%d %s: %v", version, filter, err)
+			}
+			for _, typ := range types {
+				if stats.Types[typ] != 0 {
+					t.Errorf("v%d %s: got %d %v objects", version, filter, stats.Types[typ], typ)
+				}
+			}
+			if stats.Types[ObjCommit] == 0 {
+				t.Errorf("v%d %s: got no commits", version, filter)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// localStream is the stdin and stdout of a local git-upload-pack.
+// Closing it stops the process.
+type localStream struct {
+	io.Reader
+	io.WriteCloser
+
+	ctx context.Context
+	cmd *exec.Cmd
+
+	// exited is set once the output is over and the process waited for,
+	// with the error of Wait in exitErr.
+	exited  bool
+	exitErr error
+}
+
+func (s *localStream) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	if err == io.EOF && !s.exited {
+		s.exited, s.exitErr = true, s.cmd.Wait()
+	}
+	return n, ctxErr(s.ctx, err)
+}
+
+func (s *localStream) Close() error {
+	if s.exited {
+		s.WriteCloser.Close()
+		return nil
+	}
+	// Kill it before closing stdin, or it might complain about it.
+	s.cmd.Process.Kill()
+	s.WriteCloser.Close()
+	s.cmd.Wait()
+	return nil
+}
+
+// fetchLocal fetches from a repository on disk, given as a file:// URL or
+// as a path, by running git-upload-pack on it.
+func fetchLocal(ctx context.Context, gitURL string, haves map[string]struct{}, opts *Options) (*Result, error) {
+	path := gitURL
+	if strings.HasPrefix(gitURL, "file://") {
+		u, err := url.Parse(gitURL)
+		if err != nil {
+			return nil, err
+		}
+		path = u.Path
+	}
+
+	// The process is killed when ctx is done, which makes Timeout work.
+	cmd := exec.CommandContext(ctx, "git-upload-pack", path)
+	if opts.ProtocolVersion == 2 {
+		cmd.Env = append(os.Environ(), "GIT_PROTOCOL=version=2")
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stream := &localStream{ctx: ctx, cmd: cmd}
+	var err error
+	if stream.WriteCloser, err = cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if stream.Reader, err = cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	res, err := fetchStream(stream, haves, opts)
+	if err != nil || res.Pack == nil {
+		// If the process failed, for example because path is not a
+		// repository, its output ended early and stderr tells why. Otherwise
+		// it was killed by Close, or the fetch was just up to date.
+		if err := uploadPackError(ctx, stream.exitErr, stderr.String()); err != nil {
+			return nil, err
+		}
+	}
+	return res, err
+}
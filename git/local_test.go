@@ -0,0 +1,54 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchLocal(t *testing.T) {
+	dir := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "repo.git")
+
+	for _, u := range []string{path, "file://" + path} {
+		for _, version := range []int{0, 2} {
+			res, err := FetchWithOptions(u, nil, &Options{ProtocolVersion: version})
+			if err != nil {
+				t.Fatalf("%s v%d: %v", u, version, err)
+			}
+			if res.ProtocolVersion != version {
+				t.Errorf("%s v%d: spoke protocol v%d", u, version, res.ProtocolVersion)
+			}
+			pack, err := ioutil.ReadAll(res.Pack)
+			res.Pack.Close()
+			if err != nil {
+				t.Fatalf("%s v%d: %v", u, version, err)
+			}
+			checkPack(t, dir, pack)
+			os.RemoveAll(filepath.Join(dir, "check.git"))
+
+			// With all the objects, there is nothing to fetch. What
+			// git-upload-pack says on stderr isn't an error then.
+			haves := make(map[string]struct{})
+			for _, ref := range res.Refs {
+				haves[ref] = struct{}{}
+			}
+			os.Setenv("GIT_TRACE", "2")
+			res, err = FetchWithOptions(u, haves, &Options{ProtocolVersion: version})
+			os.Unsetenv("GIT_TRACE")
+			if err != nil {
+				t.Fatalf("%s v%d: %v", u, version, err)
+			}
+			if res.Pack != nil {
+				t.Errorf("%s v%d: got a packfile", u, version)
+			}
+		}
+	}
+
+	_, _, err := Fetch(filepath.Join(dir, "missing.git"), nil, nil, nil)
+	if _, ok := err.(RemoteError); !ok {
+		t.Errorf("missing repository: expected a RemoteError, got %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// https://github.com/git/git/blob/master/Documentation/technical/pack-protocol.txt
+// (Packfile Negotiation)
+
+const (
+	// haveBatchSize is the number of haves sent in each round.
+	haveBatchSize = 32
+
+	// maxInVain is the number of haves we send without finding anything in
+	// common before giving up, like git does.
+	maxInVain = 256
+)
+
+// negotiation keeps track of the haves we sent and of the server answers.
+type negotiation struct {
+	// pending are the haves left to send, newest first.
+	pending []string
+	common  []string
+	ready   bool
+
+	// multiAck is set if the server supports multi_ack_detailed (always
+	// with protocol v2), noDone if it supports no-done.
+	multiAck, noDone bool
+
+	inVain int
+	sent   int
+	seen   map[string]bool
+}
+
+func newNegotiation(haves map[string]struct{}, opts *Options, multiAck, noDone bool) *negotiation {
+	return &negotiation{
+		pending:  sortHaves(haves, opts.HaveDates),
+		multiAck: multiAck,
+		noDone:   noDone,
+		seen:     make(map[string]bool),
+	}
+}
+
+// sortHaves returns the haves newest first according to dates, followed by
+// the ones without a date sorted by ID.
+func sortHaves(haves map[string]struct{}, dates map[string]time.Time) []string {
+	var res []string
+	for have := range haves {
+		res = append(res, have)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		di, iok := dates[res[i]]
+		dj, jok := dates[res[j]]
+		if iok != jok {
+			return iok
+		}
+		if iok && !di.Equal(dj) {
+			return di.After(dj)
+		}
+		return res[i] < res[j]
+	})
+	return res
+}
+
+// next returns the haves to send in the next round. If last is set, the
+// round must end with "done".
+func (n *negotiation) next() (batch []string, last bool) {
+	if n.ready || n.inVain >= maxInVain {
+		return nil, true
+	}
+	size := haveBatchSize
+	if !n.multiAck {
+		// Without multi_ack_detailed the server doesn't answer each round,
+		// so send all the haves at once.
+		size = maxInVain
+	}
+	if size > len(n.pending) {
+		size = len(n.pending)
+	}
+	batch, n.pending = n.pending[:size], n.pending[size:]
+	n.sent += size
+	n.inVain += size
+	return batch, len(n.pending) == 0 || !n.multiAck
+}
+
+func (n *negotiation) ack(id string) {
+	if n.seen[id] {
+		return
+	}
+	n.seen[id] = true
+	n.common = append(n.common, id)
+	n.inVain = 0
+}
+
+// writeHaves writes the have lines of a round. In stateless mode, the
+// common haves of the previous rounds are repeated, since the server
+// doesn't remember them.
+func (n *negotiation) writeHaves(w *bytes.Buffer, batch []string, stateless bool) {
+	if stateless {
+		for _, have := range n.common {
+			writePktLine(w, "have "+have+"\n")
+		}
+	}
+	for _, have := range batch {
+		writePktLine(w, "have "+have+"\n")
+	}
+}
+
+// readAcks reads the protocol v0 answer to a round. It returns true when
+// the packfile follows.
+func (n *negotiation) readAcks(r io.Reader, last bool) (pack bool, err error) {
+	for {
+		line, pktLen, err := readPktLine(r)
+		if err != nil {
+			return false, err
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			return false, RemoteError{strings.TrimPrefix(line, "ERR ")}
+		}
+		fields := strings.Fields(line)
+		switch {
+		case pktLen == 0:
+			return false, GitParseError{"ACK"}
+		case line == "NAK":
+			if last {
+				return true, nil
+			}
+			if !n.ready || !n.noDone {
+				return false, nil
+			}
+			// With no-done, the final ACK and the packfile follow.
+		case len(fields) == 2 && fields[0] == "ACK":
+			// The final ACK, which comes before the packfile.
+			return true, nil
+		case len(fields) == 3 && fields[0] == "ACK" && fields[2] == "common":
+			n.ack(fields[1])
+		case len(fields) == 3 && fields[0] == "ACK" && fields[2] == "ready":
+			n.ready = true
+		default:
+			return false, GitParseError{"ACK"}
+		}
+	}
+}
+
+// negotiateV0 runs the protocol v0 negotiation, starting with the wants
+// built by buildWants. send sends a request and returns the response,
+// which for a stateful connection is just the next part of the stream. When
+// it returns, the last response is positioned at the beginning of the
+// packfile.
+func negotiateV0(send func(*bytes.Buffer) (io.Reader, error), wants *bytes.Buffer,
+	n *negotiation, opts *Options, res *Result, stateless bool) error {
+
+	for first := true; ; first = false {
+		batch, last := n.next()
+		req := &bytes.Buffer{}
+		if first || stateless {
+			req.Write(wants.Bytes())
+		}
+		n.writeHaves(req, batch, stateless)
+		if last {
+			req.WriteString("0009done\n")
+		} else {
+			req.WriteString("0000")
+		}
+
+		r, err := send(req)
+		if err != nil {
+			return err
+		}
+		if (first || stateless) && opts.shallow() {
+			res.Shallow, res.Unshallow = nil, nil
+			if err := readShallowInfo(r, res); err != nil {
+				return err
+			}
+		}
+		pack, err := n.readAcks(r, last)
+		if err != nil {
+			return err
+		}
+		if pack {
+			res.HavesSent = n.sent
+			return nil
+		}
+	}
+}
+
+// readAcksV2 reads a protocol v2 acknowledgments section, and returns the
+// length of the special packet that ends it.
+func (n *negotiation) readAcksV2(r io.Reader) (pktLen int, err error) {
+	for {
+		line, pktLen, err := readPktLine(r)
+		if err != nil {
+			return 0, err
+		}
+		if pktLen < 4 {
+			return pktLen, nil
+		}
+		switch {
+		case line == "NAK":
+		case line == "ready":
+			n.ready = true
+		case strings.HasPrefix(line, "ACK "):
+			n.ack(strings.TrimPrefix(line, "ACK "))
+		default:
+			return 0, GitParseError{"acknowledgments"}
+		}
+	}
+}
+
+// negotiateV2 runs the protocol v2 negotiation, which is stateless, with a
+// fetch command per round. When it returns, the last response is
+// positioned at the beginning of the sideband-multiplexed packfile data.
+func negotiateV2(send func(*bytes.Buffer) (io.Reader, error), caps Capabilities,
+	wants []string, n *negotiation, opts *Options, res *Result) error {
+
+	for {
+		batch, last := n.next()
+		req, err := buildFetchV2Request(caps, wants, n, batch, last, opts)
+		if err != nil {
+			return err
+		}
+		r, err := send(req)
+		if err != nil {
+			return err
+		}
+		pack, err := readFetchV2Response(r, res, n)
+		if err != nil {
+			return err
+		}
+		if pack {
+			res.HavesSent = n.sent
+			return nil
+		}
+		if last {
+			return errNoPackfile
+		}
+	}
+}
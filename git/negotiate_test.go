@@ -0,0 +1,115 @@
+package git
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newGitDaemon serves the repositories in root over git://.
+func newGitDaemon(t *testing.T, root string) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = l.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	l.Close()
+
+	cmd := exec.Command("git", "daemon", "--export-all", "--reuseaddr",
+		"--listen=127.0.0.1", "--port="+port, "--base-path="+root, root)
+	if err := cmd.Start(); err != nil {
+		t.Skip("can't run git daemon:", err)
+	}
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			cmd.Process.Kill()
+			t.Fatal("git daemon didn't start")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return addr, func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+}
+
+func TestSortHaves(t *testing.T) {
+	now := time.Now()
+	haves := map[string]struct{}{"a": {}, "b": {}, "c": {}, "d": {}}
+	dates := map[string]time.Time{"c": now, "d": now.Add(time.Hour)}
+	if got := sortHaves(haves, dates); !reflect.DeepEqual(got, []string{"d", "c", "a", "b"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+// fakeHaves returns n object IDs that the server doesn't have, dated after
+// date so that they are sent first.
+func fakeHaves(n int, haves map[string]struct{}, dates map[string]time.Time, date time.Time) {
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprint("fake", i))))
+		haves[id] = struct{}{}
+		dates[id] = date.Add(time.Duration(i+1) * time.Second)
+	}
+}
+
+func TestFetchNegotiation(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	runGit(t, "-C", work, "push", "-q", dir+"/repo.git", "master")
+	srv := newHTTPBackend(t, dir, false)
+	defer srv.Close()
+	addr, stop := newGitDaemon(t, dir)
+	defer stop()
+	common := runGit(t, "-C", work, "rev-parse", "master~2")
+
+	for _, u := range []string{srv.URL + "/repo.git", "git://" + addr + "/repo.git"} {
+		for _, version := range []int{0, 2} {
+			// The common commit comes after 100 the server doesn't know.
+			haves := map[string]struct{}{common: {}}
+			dates := map[string]time.Time{common: time.Now()}
+			fakeHaves(100, haves, dates, time.Now())
+			res, err := FetchWithOptions(u, haves, &Options{ProtocolVersion: version, HaveDates: dates})
+			if err != nil {
+				t.Fatalf("%s v%d: %v", u, version, err)
+			}
+			stats, err := VerifyPack(res.Pack)
+			res.Pack.Close()
+			if err != nil {
+				t.Fatalf("%s v%d: %v", u, version, err)
+			}
+			if stats.Types[ObjCommit] != 2 {
+				t.Errorf("%s v%d: got %d commits, expected only the 2 new ones", u, version, stats.Types[ObjCommit])
+			}
+			if res.HavesSent != 101 {
+				t.Errorf("%s v%d: sent %d haves", u, version, res.HavesSent)
+			}
+
+			// Nothing in common, so we give up after maxInVain.
+			haves = make(map[string]struct{})
+			fakeHaves(maxInVain*2, haves, dates, time.Now())
+			res, err = FetchWithOptions(u, haves, &Options{ProtocolVersion: version, HaveDates: dates})
+			if err != nil {
+				t.Fatalf("%s v%d: %v", u, version, err)
+			}
+			stats, err = VerifyPack(res.Pack)
+			res.Pack.Close()
+			if err != nil {
+				t.Fatalf("%s v%d: %v", u, version, err)
+			}
+			if res.HavesSent != maxInVain {
+				t.Errorf("%s v%d: sent %d haves", u, version, res.HavesSent)
+			}
+		}
+	}
+}
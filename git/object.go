@@ -0,0 +1,441 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thecodearchive/gitarchive/lru"
+)
+
+// ErrObjectNotFound is returned by ObjectReader.ReadObject when the object
+// is not there.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectReader gives access to git objects by ID.
+type ObjectReader interface {
+	// ReadObject returns the type and the full contents of an object.
+	ReadObject(id string) (ObjectType, []byte, error)
+}
+
+// MultiObjectReader looks for objects in each ObjectReader in turn.
+type MultiObjectReader []ObjectReader
+
+func (m MultiObjectReader) ReadObject(id string) (ObjectType, []byte, error) {
+	for _, r := range m {
+		t, data, err := r.ReadObject(id)
+		if err == ErrObjectNotFound {
+			continue
+		}
+		return t, data, err
+	}
+	return 0, nil, ErrObjectNotFound
+}
+
+// HasObject reports whether r has the object id. If r has a HasObject
+// method, like Pack and MultiObjectReader, it's used instead of reading the
+// object.
+func HasObject(r ObjectReader, id string) bool {
+	if h, ok := r.(interface {
+		HasObject(id string) bool
+	}); ok {
+		return h.HasObject(id)
+	}
+	_, _, err := r.ReadObject(id)
+	return err == nil
+}
+
+func (m MultiObjectReader) HasObject(id string) bool {
+	for _, r := range m {
+		if HasObject(r, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// HashObject returns the ID of an object.
+func HashObject(t ObjectType, data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", t, len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ObjectDate returns the committer date of a commit, or the tagger date of
+// an annotated tag. ok is false for other objects, or if the date is
+// missing or malformed.
+func ObjectDate(t ObjectType, data []byte) (date time.Time, ok bool) {
+	var field string
+	switch t {
+	case ObjCommit:
+		field = "committer "
+	case ObjTag:
+		field = "tagger "
+	default:
+		return time.Time{}, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			// End of the headers.
+			break
+		}
+		if !strings.HasPrefix(line, field) {
+			continue
+		}
+		// Name <email> 1465225260 +0200
+		parts := strings.Fields(line)
+		if len(parts) < 3 {
+			return time.Time{}, false
+		}
+		sec, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(sec, 0), true
+	}
+	return time.Time{}, false
+}
+
+// TreeEntry is an entry of a tree object.
+type TreeEntry struct {
+	// Mode is the file mode, like 0100644 for a file, 040000 for a
+	// directory or 0160000 for a submodule commit.
+	Mode uint32
+	Name string
+	ID   string
+}
+
+// ModeSubmodule is the mode of the tree entries of submodules, which point
+// to commits of another repository.
+const ModeSubmodule = 0160000
+
+// ParseTree returns the entries of a tree object.
+func ParseTree(data []byte) ([]TreeEntry, error) {
+	var res []TreeEntry
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+21 {
+			return nil, errors.New("malformed tree object")
+		}
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return nil, errors.New("malformed tree object")
+		}
+		res = append(res, TreeEntry{
+			Mode: uint32(mode),
+			Name: string(data[sp+1 : nul]),
+			ID:   hex.EncodeToString(data[nul+1 : nul+21]),
+		})
+		data = data[nul+21:]
+	}
+	return res, nil
+}
+
+// ErrPathNotFound is returned by FindPath when there is nothing at the
+// path.
+var ErrPathNotFound = errors.New("path not found")
+
+// FindPath returns the tree entry at path in the tree of commit. The path
+// is slash-separated, and the root, "", is the tree itself.
+func FindPath(r ObjectReader, commit, path string) (TreeEntry, error) {
+	tree, _, err := commitTreeDate(r, commit)
+	if err != nil {
+		return TreeEntry{}, err
+	}
+	entry := TreeEntry{Mode: 040000, ID: tree}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if entry.Mode != 040000 {
+			return TreeEntry{}, ErrPathNotFound
+		}
+		_, data, err := r.ReadObject(entry.ID)
+		if err != nil {
+			return TreeEntry{}, fmt.Errorf("reading tree %s: %v", entry.ID, err)
+		}
+		entries, err := ParseTree(data)
+		if err != nil {
+			return TreeEntry{}, err
+		}
+		found := false
+		for _, e := range entries {
+			if e.Name == name {
+				entry, found = e, true
+				break
+			}
+		}
+		if !found {
+			return TreeEntry{}, ErrPathNotFound
+		}
+	}
+	return entry, nil
+}
+
+// Pack gives random access to the objects of a packfile using its index.
+// It is safe for concurrent use.
+type Pack struct {
+	r   io.ReaderAt
+	idx *PackIndex
+
+	// Bases is used to resolve ref-deltas against objects that are not in
+	// the packfile, like in thin packs. It can be nil.
+	Bases ObjectReader
+
+	// ids is used instead of idx while indexing.
+	ids map[string]int64
+
+	mu    sync.Mutex
+	cache *lru.Cache
+}
+
+// deltaBaseCacheSize is the number of resolved objects kept around by each
+// Pack, since delta chains often share their bases. Only objects smaller
+// than maxCachedObjectSize are cached.
+const (
+	deltaBaseCacheSize  = 256
+	maxCachedObjectSize = 1 << 20
+)
+
+// NewPack returns a Pack reading the packfile from r, which has index idx.
+func NewPack(r io.ReaderAt, idx *PackIndex, bases ObjectReader) *Pack {
+	return &Pack{r: r, idx: idx, Bases: bases, cache: lru.New(deltaBaseCacheSize)}
+}
+
+// Index returns the index of the packfile.
+func (p *Pack) Index() *PackIndex {
+	return p.idx
+}
+
+func (p *Pack) offsetOf(id string) (int64, bool) {
+	if p.idx != nil {
+		return p.idx.Lookup(id)
+	}
+	offset, ok := p.ids[id]
+	return offset, ok
+}
+
+// HasObject reports whether the object id is in the packfile, looking only
+// at the index.
+func (p *Pack) HasObject(id string) bool {
+	_, ok := p.offsetOf(id)
+	return ok
+}
+
+// ReadObject returns an object of the packfile, or one of its thin-pack
+// bases.
+func (p *Pack) ReadObject(id string) (ObjectType, []byte, error) {
+	offset, ok := p.offsetOf(id)
+	if !ok {
+		return 0, nil, ErrObjectNotFound
+	}
+	return p.ReadObjectAt(offset)
+}
+
+type cachedObject struct {
+	t    ObjectType
+	data []byte
+}
+
+// ReadObjectAt returns the object at offset in the packfile, with any delta
+// resolved. The returned slice must not be modified.
+func (p *Pack) ReadObjectAt(offset int64) (ObjectType, []byte, error) {
+	key := strconv.FormatInt(offset, 10)
+	p.mu.Lock()
+	o, ok := p.cache.Get(key)
+	p.mu.Unlock()
+	if ok {
+		return o.(*cachedObject).t, o.(*cachedObject).data, nil
+	}
+
+	obj, data, err := p.readRaw(offset)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	t := obj.Type
+	switch obj.Type {
+	case ObjOfsDelta, ObjRefDelta:
+		var base []byte
+		if obj.Type == ObjOfsDelta {
+			t, base, err = p.ReadObjectAt(obj.BaseOffset)
+		} else if baseOffset, ok := p.offsetOf(obj.BaseID); ok {
+			t, base, err = p.ReadObjectAt(baseOffset)
+		} else if p.Bases != nil {
+			t, base, err = p.Bases.ReadObject(obj.BaseID)
+		} else {
+			err = ErrObjectNotFound
+		}
+		if err == ErrObjectNotFound {
+			return 0, nil, MissingBaseError{obj.Offset, obj.BaseID}
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		data, err = applyDelta(base, data)
+		if err != nil {
+			return 0, nil, PackFormatError{obj.Offset, err.Error()}
+		}
+	}
+
+	if len(data) < maxCachedObjectSize {
+		p.mu.Lock()
+		p.cache.Add(key, &cachedObject{t, data})
+		p.mu.Unlock()
+	}
+	return t, data, nil
+}
+
+// MissingBaseError is returned when the base of a delta can't be found.
+type MissingBaseError struct {
+	Offset int64
+	BaseID string
+}
+
+func (e MissingBaseError) Error() string {
+	if e.BaseID == "" {
+		return fmt.Sprintf("missing delta base for object at offset %d", e.Offset)
+	}
+	return fmt.Sprintf("missing delta base %s for object at offset %d", e.BaseID, e.Offset)
+}
+
+// readRaw returns the header and the inflated data of the object at offset,
+// without resolving deltas.
+func (p *Pack) readRaw(offset int64) (*PackObject, []byte, error) {
+	br := bufio.NewReader(io.NewSectionReader(p.r, offset, 1<<62))
+	obj, err := readObjectHeader(br, offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	z, err := zlib.NewReader(br)
+	if err != nil {
+		return nil, nil, PackFormatError{offset, "inflating: " + err.Error()}
+	}
+	defer z.Close()
+	if obj.Size < 0 || obj.Size > maxObjectSize {
+		return nil, nil, PackFormatError{offset, fmt.Sprintf("object too large (%d bytes)", obj.Size)}
+	}
+	// Don't trust the size to allocate, grow the buffer as the data comes.
+	buf := bytes.NewBuffer(make([]byte, 0, minInt64(obj.Size, bytes.MinRead)))
+	if _, err := buf.ReadFrom(io.LimitReader(z, obj.Size)); err != nil {
+		return nil, nil, PackFormatError{offset, "inflating: " + err.Error()}
+	}
+	if int64(buf.Len()) != obj.Size {
+		return nil, nil, PackFormatError{offset, "object shorter than its declared size"}
+	}
+	return obj, buf.Bytes(), nil
+}
+
+// maxObjectSize bounds the size of the objects read in memory, which comes
+// from the packfile, and can't be trusted.
+const maxObjectSize = 1 << 30
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// applyDelta applies the delta instructions to base.
+// https://github.com/git/git/blob/master/Documentation/technical/pack-format.txt
+func applyDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	baseSize, err := readDeltaSize(r)
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != uint64(len(base)) {
+		return nil, errors.New("delta base size mismatch")
+	}
+	resultSize, err := readDeltaSize(r)
+	if err != nil {
+		return nil, err
+	}
+	if resultSize > maxObjectSize {
+		return nil, fmt.Errorf("delta result too large (%d bytes)", resultSize)
+	}
+	// resultSize is only checked against the result once it's built.
+	var result []byte
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		if op&0x80 != 0 {
+			// Copy from base.
+			var offset, size uint64
+			for i := uint(0); i < 4; i++ {
+				if op&(1<<i) != 0 {
+					b, err := r.ReadByte()
+					if err != nil {
+						return nil, errors.New("truncated delta")
+					}
+					offset |= uint64(b) << (8 * i)
+				}
+			}
+			for i := uint(0); i < 3; i++ {
+				if op&(0x10<<i) != 0 {
+					b, err := r.ReadByte()
+					if err != nil {
+						return nil, errors.New("truncated delta")
+					}
+					size |= uint64(b) << (8 * i)
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > uint64(len(base)) {
+				return nil, errors.New("delta copy out of bounds")
+			}
+			if uint64(len(result))+size > resultSize {
+				return nil, errors.New("delta result size mismatch")
+			}
+			result = append(result, base[offset:offset+size]...)
+		} else if op != 0 {
+			// Insert the next op bytes.
+			n := int(op)
+			if n > r.Len() {
+				return nil, errors.New("truncated delta")
+			}
+			if uint64(len(result)+n) > resultSize {
+				return nil, errors.New("delta result size mismatch")
+			}
+			start := len(delta) - r.Len()
+			result = append(result, delta[start:start+n]...)
+			r.Seek(int64(n), io.SeekCurrent)
+		} else {
+			return nil, errors.New("reserved delta opcode")
+		}
+	}
+	if uint64(len(result)) != resultSize {
+		return nil, errors.New("delta result size mismatch")
+	}
+	return result, nil
+}
+
+func readDeltaSize(r io.ByteReader) (uint64, error) {
+	var size uint64
+	for shift := uint(0); ; shift += 7 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errors.New("truncated delta header")
+		}
+		size |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return size, nil
+		}
+		if shift > 56 {
+			return 0, errors.New("delta size overflow")
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+)
+
+// packWithSize makes a packfile with a blob of content data, but with size
+// in its header.
+func packWithSize(size uint64, data string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("PACK")
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+	binary.Write(&buf, binary.BigEndian, uint32(1))
+	c := byte(ObjBlob)<<4 | byte(size&0x0f)
+	size >>= 4
+	for size > 0 {
+		buf.WriteByte(c | 0x80)
+		c = byte(size & 0x7f)
+		size >>= 7
+	}
+	buf.WriteByte(c)
+	z := zlib.NewWriter(&buf)
+	z.Write([]byte(data))
+	z.Close()
+	return buf.Bytes()
+}
+
+func TestReadObjectBadSize(t *testing.T) {
+	for _, size := range []uint64{1 << 59, 1 << 40, 1 << 29} {
+		p := NewPack(bytes.NewReader(packWithSize(size, "hello\n")), nil, nil)
+		if _, _, err := p.ReadObjectAt(12); err == nil {
+			t.Errorf("size %d: no error", size)
+		} else if _, ok := err.(PackFormatError); !ok {
+			t.Errorf("size %d: got error %v", size, err)
+		}
+	}
+	p := NewPack(bytes.NewReader(packWithSize(6, "hello\n")), nil, nil)
+	if _, data, err := p.ReadObjectAt(12); err != nil || string(data) != "hello\n" {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
+
+func TestApplyDeltaBadSize(t *testing.T) {
+	base := []byte("hello\n")
+	for name, delta := range map[string][]byte{
+		// Base size 6, result size 2^63, insert "a".
+		"huge": {6, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01, 1, 'a'},
+		// Result size 2^20, copy the base.
+		"short": {6, 0x80, 0x80, 0x40, 0x90, 6},
+		// Result size 1, copy the base.
+		"long": {6, 1, 0x90, 6},
+	} {
+		if _, err := applyDelta(base, delta); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if got, err := applyDelta(base, []byte{6, 7, 0x90, 6, 1, '!'}); err != nil || string(got) != "hello\n!" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestObjectDate(t *testing.T) {
+	commit := "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+		"author A U Thor <author@example.com> 1112911993 -0700\n" +
+		"committer C O Mitter <committer@example.com> 1112912053 -0700\n" +
+		"\ncommitter 1 +0000\n"
+	date, ok := ObjectDate(ObjCommit, []byte(commit))
+	if !ok || date.Unix() != 1112912053 {
+		t.Errorf("got %v, %v", date, ok)
+	}
+	if _, ok := ObjectDate(ObjBlob, []byte(commit)); ok {
+		t.Error("got a date for a blob")
+	}
+}
+
+func TestFindPath(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	p := indexedPack(t, packObjects(t, work, "", "--all"), nil)
+	commit := runGit(t, "-C", work, "rev-parse", "HEAD")
+
+	for _, path := range []string{"", "/", "file", "/file"} {
+		e, err := FindPath(p, commit, path)
+		if err != nil {
+			t.Fatalf("%q: %v", path, err)
+		}
+		expected := runGit(t, "-C", work, "rev-parse", "HEAD:"+strings.TrimPrefix(path, "/"))
+		if e.ID != expected {
+			t.Errorf("%q: got %s, expected %s", path, e.ID, expected)
+		}
+	}
+	for _, path := range []string{"missing", "file/below"} {
+		if _, err := FindPath(p, commit, path); err != ErrPathNotFound {
+			t.Errorf("%q: got error %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+// https://github.com/git/git/blob/master/Documentation/technical/pack-format.txt
+
+type ObjectType int8
+
+const (
+	ObjCommit   ObjectType = 1
+	ObjTree     ObjectType = 2
+	ObjBlob     ObjectType = 3
+	ObjTag      ObjectType = 4
+	ObjOfsDelta ObjectType = 6
+	ObjRefDelta ObjectType = 7
+)
+
+func (t ObjectType) String() string {
+	switch t {
+	case ObjCommit:
+		return "commit"
+	case ObjTree:
+		return "tree"
+	case ObjBlob:
+		return "blob"
+	case ObjTag:
+		return "tag"
+	case ObjOfsDelta:
+		return "ofs-delta"
+	case ObjRefDelta:
+		return "ref-delta"
+	default:
+		return "unknown-" + strconv.Itoa(int(t))
+	}
+}
+
+// PackFormatError is returned when a packfile is malformed or corrupted.
+type PackFormatError struct {
+	Offset int64
+	Reason string
+}
+
+func (e PackFormatError) Error() string {
+	return fmt.Sprintf("bad packfile at offset %d: %s", e.Offset, e.Reason)
+}
+
+// PackObject is the header of an object in a packfile.
+type PackObject struct {
+	Type ObjectType
+
+	// Size is the size of the inflated data, which for deltas is the
+	// size of the delta itself, not of the resulting object.
+	Size int64
+
+	// Offset is the position of the object header in the packfile.
+	Offset int64
+
+	// BaseOffset is the position of the base of an ObjOfsDelta.
+	BaseOffset int64
+
+	// BaseID is the object ID of the base of an ObjRefDelta.
+	BaseID string
+
+	// ID and CRC32 are set once the object data is fully read, or skipped
+	// by PackReader.Next. ID is the object ID, and it is only set for
+	// non-delta objects. CRC32 is the checksum of the raw packed object,
+	// header included, as recorded in .idx files.
+	ID    string
+	CRC32 uint32
+}
+
+// packStream hashes and counts all the bytes read from it.
+// It implements io.ByteReader so that zlib doesn't read past the end of
+// each object.
+type packStream struct {
+	r      *bufio.Reader
+	sha    hash.Hash
+	crc    hash.Hash32
+	offset int64
+}
+
+func (s *packStream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.sha.Write(p[:n])
+	s.crc.Write(p[:n])
+	s.offset += int64(n)
+	return n, err
+}
+
+func (s *packStream) ReadByte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	s.sha.Write([]byte{b})
+	s.crc.Write([]byte{b})
+	s.offset++
+	return b, nil
+}
+
+// PackReader reads a packfile stream object by object, checking its
+// structure and checksums as it goes.
+type PackReader struct {
+	s *packStream
+
+	// Version is the packfile version, 2 or 3.
+	Version uint32
+	// Count is the number of objects in the packfile.
+	Count uint32
+
+	read     uint32
+	cur      *PackObject
+	curZ     io.ReadCloser
+	curN     int64
+	curSHA   hash.Hash
+	checksum string
+}
+
+// NewPackReader reads the packfile header from r and returns a PackReader
+// positioned before the first object.
+func NewPackReader(r io.Reader) (*PackReader, error) {
+	s := &packStream{r: bufio.NewReader(r), sha: sha1.New(), crc: crc32.NewIEEE()}
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(s, hdr); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if string(hdr[:4]) != "PACK" {
+		return nil, PackFormatError{0, "missing PACK signature"}
+	}
+	p := &PackReader{
+		s:       s,
+		Version: binary.BigEndian.Uint32(hdr[4:8]),
+		Count:   binary.BigEndian.Uint32(hdr[8:12]),
+	}
+	if p.Version != 2 && p.Version != 3 {
+		return nil, PackFormatError{4, fmt.Sprintf("unsupported version %d", p.Version)}
+	}
+	return p, nil
+}
+
+// Next skips the rest of the current object, if any, and returns the header
+// of the next one. After the last object it checks the packfile trailer and
+// returns io.EOF.
+func (p *PackReader) Next() (*PackObject, error) {
+	if p.cur != nil {
+		if _, err := io.Copy(ioutil.Discard, p); err != nil {
+			return nil, err
+		}
+	}
+	if p.read == p.Count {
+		if p.checksum == "" {
+			if err := p.readTrailer(); err != nil {
+				return nil, err
+			}
+		}
+		return nil, io.EOF
+	}
+	p.read++
+
+	p.s.crc.Reset()
+	obj, err := readObjectHeader(p.s, p.s.offset)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Type == ObjOfsDelta || obj.Type == ObjRefDelta {
+		p.curSHA = nil
+	} else {
+		p.curSHA = sha1.New()
+		fmt.Fprintf(p.curSHA, "%s %d\x00", obj.Type, obj.Size)
+	}
+
+	z, err := zlib.NewReader(p.s)
+	if err != nil {
+		return nil, p.inflateError(obj, err)
+	}
+	p.cur, p.curZ, p.curN = obj, z, 0
+	return obj, nil
+}
+
+// readObjectHeader reads the header of the object at offset from r,
+// including the delta base reference, if any.
+func readObjectHeader(r flateReader, offset int64) (*PackObject, error) {
+	obj := &PackObject{Offset: offset}
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	obj.Type = ObjectType((c >> 4) & 7)
+	obj.Size = int64(c & 0x0f)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if shift > 56 {
+			return nil, PackFormatError{obj.Offset, "object size overflow"}
+		}
+		if c, err = r.ReadByte(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		obj.Size |= int64(c&0x7f) << shift
+	}
+
+	switch obj.Type {
+	case ObjCommit, ObjTree, ObjBlob, ObjTag:
+	case ObjOfsDelta:
+		if c, err = r.ReadByte(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		ofs := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if ofs >= 1<<56 {
+				return nil, PackFormatError{obj.Offset, "delta offset overflow"}
+			}
+			if c, err = r.ReadByte(); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			ofs = ((ofs + 1) << 7) | int64(c&0x7f)
+		}
+		obj.BaseOffset = obj.Offset - ofs
+		if ofs == 0 || obj.BaseOffset < 12 {
+			return nil, PackFormatError{obj.Offset, "bad delta base offset"}
+		}
+	case ObjRefDelta:
+		base := make([]byte, 20)
+		if _, err := io.ReadFull(r, base); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		obj.BaseID = hex.EncodeToString(base)
+	default:
+		return nil, PackFormatError{obj.Offset, "bad object type " + obj.Type.String()}
+	}
+	return obj, nil
+}
+
+// flateReader is an io.Reader that zlib can use without reading ahead.
+type flateReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Read reads the inflated data of the current object. For deltas, that's
+// the delta instructions.
+func (p *PackReader) Read(b []byte) (int, error) {
+	if p.cur == nil {
+		return 0, io.EOF
+	}
+	if rem := p.cur.Size - p.curN; int64(len(b)) > rem {
+		// Read one byte past the size, to catch objects that are longer.
+		b = b[:rem+1]
+	}
+	n, err := p.curZ.Read(b)
+	p.curN += int64(n)
+	if p.curSHA != nil {
+		p.curSHA.Write(b[:n])
+	}
+	if p.curN > p.cur.Size {
+		return n, PackFormatError{p.cur.Offset, "object longer than its declared size"}
+	}
+	if err == io.EOF {
+		if p.curN != p.cur.Size {
+			return n, PackFormatError{p.cur.Offset, "object shorter than its declared size"}
+		}
+		if err := p.curZ.Close(); err != nil {
+			return n, p.inflateError(p.cur, err)
+		}
+		p.cur.CRC32 = p.s.crc.Sum32()
+		if p.curSHA != nil {
+			p.cur.ID = hex.EncodeToString(p.curSHA.Sum(nil))
+		}
+		p.cur = nil
+		return n, io.EOF
+	}
+	if err != nil {
+		return n, p.inflateError(p.cur, err)
+	}
+	return n, nil
+}
+
+func (p *PackReader) readTrailer() error {
+	sum := p.s.sha.Sum(nil)
+	trailer := make([]byte, 20)
+	if _, err := io.ReadFull(p.s.r, trailer); err != nil {
+		return unexpectedEOF(err)
+	}
+	if !bytes.Equal(sum, trailer) {
+		return PackFormatError{p.s.offset, "checksum mismatch"}
+	}
+	p.checksum = hex.EncodeToString(trailer)
+	p.s.offset += 20
+	if _, err := p.s.r.ReadByte(); err != io.EOF {
+		return PackFormatError{p.s.offset, "trailing data after the checksum"}
+	}
+	return nil
+}
+
+// Checksum returns the SHA-1 trailer of the packfile in hex, once Next
+// returned io.EOF.
+func (p *PackReader) Checksum() string {
+	return p.checksum
+}
+
+func (p *PackReader) inflateError(obj *PackObject, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return io.ErrUnexpectedEOF
+	}
+	return PackFormatError{obj.Offset, "inflating " + obj.Type.String() + ": " + err.Error()}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// writePackObject writes a whole, non-delta object in packfile format.
+func writePackObject(w io.Writer, t ObjectType, data []byte) error {
+	size := len(data)
+	var hdr []byte
+	c := byte(t)<<4 | byte(size&0x0f)
+	for size >>= 4; size > 0; size >>= 7 {
+		hdr = append(hdr, c|0x80)
+		c = byte(size & 0x7f)
+	}
+	hdr = append(hdr, c)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	z := zlib.NewWriter(w)
+	if _, err := z.Write(data); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// newPackStream returns a packfile made of the count objects in body,
+// which were written with writePackObject or copied from another packfile
+// with their offset deltas still valid. The trailer is computed as the
+// packfile is read.
+func newPackStream(count uint32, body io.Reader) io.Reader {
+	h := sha1.New()
+	hdr := bytes.NewReader(packHeader(count))
+	return io.MultiReader(io.TeeReader(io.MultiReader(hdr, body), h), &trailerReader{h: h})
+}
+
+// packHeader returns the header of a version 2 packfile of count objects.
+func packHeader(count uint32) []byte {
+	var hdr bytes.Buffer
+	hdr.WriteString("PACK")
+	binary.Write(&hdr, binary.BigEndian, uint32(2))
+	binary.Write(&hdr, binary.BigEndian, count)
+	return hdr.Bytes()
+}
+
+// trailerReader reads the checksum of what went through h so far, the
+// first time it's read from.
+type trailerReader struct {
+	h   hash.Hash
+	sum []byte
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	if t.sum == nil {
+		t.sum = t.h.Sum(nil)
+	}
+	if len(t.sum) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, t.sum)
+	t.sum = t.sum[n:]
+	return n, nil
+}
+
+// PackStats are the results of a packfile verification.
+type PackStats struct {
+	Objects  int
+	Types    map[ObjectType]int
+	Checksum string
+}
+
+// VerifyPack reads a whole packfile from r and checks it.
+func VerifyPack(r io.Reader) (*PackStats, error) {
+	p, err := NewPackReader(r)
+	if err != nil {
+		return nil, err
+	}
+	stats := &PackStats{Types: make(map[ObjectType]int)}
+	for {
+		obj, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats.Objects++
+		stats.Types[obj.Type]++
+	}
+	stats.Checksum = p.Checksum()
+	return stats, nil
+}
+
+var errVerifierClosed = errors.New("pack verifier closed")
+
+// PackVerifier is a reader that returns the packfile read from the
+// underlying reader unchanged, while checking it. If the packfile is
+// invalid, Read returns an error, at the latest in place of io.EOF.
+type PackVerifier struct {
+	r     io.Reader
+	pw    *io.PipeWriter
+	done  chan struct{}
+	stats *PackStats
+	err   error
+}
+
+// NewPackVerifier returns a PackVerifier reading from r. Close must be
+// called if the packfile is not read to the end.
+func NewPackVerifier(r io.Reader) *PackVerifier {
+	pr, pw := io.Pipe()
+	v := &PackVerifier{r: r, pw: pw, done: make(chan struct{})}
+	go func() {
+		v.stats, v.err = VerifyPack(pr)
+		if v.err != nil {
+			pr.CloseWithError(v.err)
+		}
+		close(v.done)
+	}()
+	return v
+}
+
+func (v *PackVerifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if n > 0 {
+		if _, err := v.pw.Write(p[:n]); err != nil {
+			return n, err
+		}
+	}
+	if err == io.EOF {
+		v.pw.Close()
+		<-v.done
+		if v.err != nil {
+			return n, v.err
+		}
+	} else if err != nil {
+		v.pw.CloseWithError(err)
+	}
+	return n, err
+}
+
+// Stats returns the results of the verification, once Read returned io.EOF.
+func (v *PackVerifier) Stats() *PackStats {
+	select {
+	case <-v.done:
+		return v.stats
+	default:
+		return nil
+	}
+}
+
+// Close stops the verification. It doesn't close the underlying reader.
+func (v *PackVerifier) Close() error {
+	v.pw.CloseWithError(errVerifierClosed)
+	<-v.done
+	return nil
+}
@@ -0,0 +1,195 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// buildPack makes a packfile out of blobs, without deltas.
+func buildPack(blobs ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("PACK")
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+	binary.Write(&buf, binary.BigEndian, uint32(len(blobs)))
+	for _, blob := range blobs {
+		size := len(blob)
+		c := byte(ObjBlob)<<4 | byte(size&0x0f)
+		size >>= 4
+		for size > 0 {
+			buf.WriteByte(c | 0x80)
+			c = byte(size & 0x7f)
+			size >>= 7
+		}
+		buf.WriteByte(c)
+		z := zlib.NewWriter(&buf)
+		z.Write([]byte(blob))
+		z.Close()
+	}
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+func blobID(blob string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("blob %d\x00%s", len(blob), blob))))
+}
+
+func TestPackReader(t *testing.T) {
+	blobs := []string{"hello\n", strings.Repeat("a long blob ", 1000), ""}
+	p, err := NewPackReader(bytes.NewReader(buildPack(blobs...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Count != 3 {
+		t.Fatalf("Count = %d", p.Count)
+	}
+	for i, blob := range blobs {
+		obj, err := p.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Type != ObjBlob || obj.Size != int64(len(blob)) {
+			t.Fatalf("object %d: got %v of size %d", i, obj.Type, obj.Size)
+		}
+		if i == 1 {
+			// Let Next skip the second one.
+			continue
+		}
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != blob {
+			t.Fatalf("object %d: wrong data %q", i, data)
+		}
+		if obj.ID != blobID(blob) {
+			t.Fatalf("object %d: wrong ID %s", i, obj.ID)
+		}
+	}
+	if _, err := p.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestVerifyPackCorrupted(t *testing.T) {
+	pack := buildPack("hello\n", "world\n")
+	flipped := append([]byte{}, pack...)
+	flipped[len(flipped)-25] ^= 0xff
+	badChecksum := append([]byte{}, pack...)
+	badChecksum[len(badChecksum)-1] ^= 0xff
+
+	for name, data := range map[string][]byte{
+		"truncated":    pack[:len(pack)-30],
+		"no trailer":   pack[:len(pack)-20],
+		"flipped byte": flipped,
+		"bad checksum": badChecksum,
+		"trailing":     append(append([]byte{}, pack...), 0),
+		"bad header":   append([]byte("KCAP"), pack[4:]...),
+	} {
+		if _, err := VerifyPack(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestPackVerifier(t *testing.T) {
+	pack := buildPack("hello\n", "world\n")
+	v := NewPackVerifier(bytes.NewReader(pack))
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, v); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), pack) {
+		t.Fatal("the packfile was altered")
+	}
+	stats := v.Stats()
+	if stats == nil || stats.Objects != 2 || stats.Types[ObjBlob] != 2 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+	if stats.Checksum != fmt.Sprintf("%x", pack[len(pack)-20:]) {
+		t.Fatalf("wrong checksum: %s", stats.Checksum)
+	}
+
+	v = NewPackVerifier(bytes.NewReader(pack[:len(pack)-1]))
+	if _, err := io.Copy(ioutil.Discard, v); err == nil {
+		t.Fatal("truncated pack passed verification")
+	}
+
+	v = NewPackVerifier(bytes.NewReader(pack))
+	io.CopyN(ioutil.Discard, v, 10)
+	v.Close()
+}
+
+// newDeltaRepo makes a test repository where a file changes a little in
+// each commit, so that git packs it with deltas. It returns the base
+// directory and the work tree.
+func newDeltaRepo(t *testing.T) (dir, work string) {
+	dir = newTestRepo(t)
+	work = filepath.Join(dir, "work")
+	content := strings.Repeat("some line of text\n", 200)
+	for i := 0; i < 5; i++ {
+		content += fmt.Sprintf("change %d\n", i)
+		if err := ioutil.WriteFile(filepath.Join(work, "file"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, "-C", work, "add", "file")
+		runGit(t, "-C", work, "commit", "-q", "-m", fmt.Sprintf("change %d", i))
+	}
+	return dir, work
+}
+
+// packObjects runs git pack-objects in work with revs on stdin.
+func packObjects(t *testing.T, work, revs string, args ...string) []byte {
+	args = append([]string{"-C", work, "pack-objects", "--stdout", "-q"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Stdin = strings.NewReader(revs)
+	pack, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pack
+}
+
+// gitPack generates a packfile with deltas with git pack-objects.
+func gitPack(t *testing.T, ofsDelta bool) (pack []byte, objects int) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	revs := runGit(t, "-C", work, "rev-list", "--objects", "--all")
+	objects = len(strings.Split(revs, "\n"))
+
+	args := []string{"--all"}
+	if ofsDelta {
+		args = append(args, "--delta-base-offset")
+	}
+	return packObjects(t, work, "", args...), objects
+}
+
+func TestVerifyGitPack(t *testing.T) {
+	for _, ofsDelta := range []bool{true, false} {
+		pack, objects := gitPack(t, ofsDelta)
+		stats, err := VerifyPack(bytes.NewReader(pack))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Objects != objects {
+			t.Errorf("got %d objects, expected %d", stats.Objects, objects)
+		}
+		deltaType := ObjRefDelta
+		if ofsDelta {
+			deltaType = ObjOfsDelta
+		}
+		if stats.Types[deltaType] == 0 {
+			t.Errorf("no %v objects: %v", deltaType, stats.Types)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// PackIndex is the index of a packfile, as stored in version 2 .idx files.
+type PackIndex struct {
+	// Entries are sorted by ID.
+	Entries []IndexEntry
+
+	// PackChecksum is the SHA-1 trailer of the packfile, in hex.
+	PackChecksum string
+}
+
+type IndexEntry struct {
+	ID     string
+	Offset int64
+	CRC32  uint32
+}
+
+// Lookup returns the offset of the object id in the packfile.
+func (idx *PackIndex) Lookup(id string) (offset int64, ok bool) {
+	i := sort.Search(len(idx.Entries), func(i int) bool { return idx.Entries[i].ID >= id })
+	if i < len(idx.Entries) && idx.Entries[i].ID == id {
+		return idx.Entries[i].Offset, true
+	}
+	return 0, false
+}
+
+var idxMagic = []byte{0xff, 't', 'O', 'c'}
+
+// WriteTo writes the index in the version 2 .idx format.
+func (idx *PackIndex) WriteTo(w io.Writer) (int64, error) {
+	h := sha1.New()
+	cw := &countingWriter{w: io.MultiWriter(w, h)}
+	bw := bufio.NewWriter(cw)
+
+	bw.Write(idxMagic)
+	binary.Write(bw, binary.BigEndian, uint32(2))
+
+	var fanout [256]uint32
+	for _, e := range idx.Entries {
+		b, err := hex.DecodeString(e.ID[:2])
+		if err != nil {
+			return cw.n, err
+		}
+		fanout[b[0]]++
+	}
+	var total uint32
+	for i := range fanout {
+		total += fanout[i]
+		binary.Write(bw, binary.BigEndian, total)
+	}
+
+	for _, e := range idx.Entries {
+		id, err := hex.DecodeString(e.ID)
+		if err != nil || len(id) != 20 {
+			return cw.n, fmt.Errorf("bad object ID %q", e.ID)
+		}
+		bw.Write(id)
+	}
+	for _, e := range idx.Entries {
+		binary.Write(bw, binary.BigEndian, e.CRC32)
+	}
+	var large []int64
+	for _, e := range idx.Entries {
+		if e.Offset < 1<<31 {
+			binary.Write(bw, binary.BigEndian, uint32(e.Offset))
+		} else {
+			binary.Write(bw, binary.BigEndian, uint32(len(large))|1<<31)
+			large = append(large, e.Offset)
+		}
+	}
+	for _, offset := range large {
+		binary.Write(bw, binary.BigEndian, uint64(offset))
+	}
+
+	packSum, err := hex.DecodeString(idx.PackChecksum)
+	if err != nil || len(packSum) != 20 {
+		return cw.n, fmt.Errorf("bad pack checksum %q", idx.PackChecksum)
+	}
+	bw.Write(packSum)
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+
+	// The trailer is the checksum of everything above, so it bypasses h.
+	_, err = w.Write(h.Sum(nil))
+	return cw.n + 20, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+var errBadIndex = errors.New("malformed pack index")
+
+// ReadPackIndex reads a version 2 .idx file.
+func ReadPackIndex(r io.Reader) (*PackIndex, error) {
+	data, err := readAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8+256*4+40 || !bytes.Equal(data[:4], idxMagic) {
+		return nil, errBadIndex
+	}
+	if v := binary.BigEndian.Uint32(data[4:8]); v != 2 {
+		return nil, fmt.Errorf("unsupported pack index version %d", v)
+	}
+	sum := sha1.Sum(data[:len(data)-20])
+	if !bytes.Equal(sum[:], data[len(data)-20:]) {
+		return nil, errors.New("pack index checksum mismatch")
+	}
+
+	n := int(binary.BigEndian.Uint32(data[8+255*4:]))
+	ids := data[8+256*4:]
+	if len(ids) < n*(20+4+4)+40 {
+		return nil, errBadIndex
+	}
+	crcs := ids[n*20:]
+	offsets := crcs[n*4:]
+	large := offsets[n*4 : len(offsets)-40]
+
+	idx := &PackIndex{
+		Entries:      make([]IndexEntry, n),
+		PackChecksum: hex.EncodeToString(data[len(data)-40 : len(data)-20]),
+	}
+	for i := range idx.Entries {
+		e := &idx.Entries[i]
+		e.ID = hex.EncodeToString(ids[i*20 : i*20+20])
+		e.CRC32 = binary.BigEndian.Uint32(crcs[i*4:])
+		offset := binary.BigEndian.Uint32(offsets[i*4:])
+		if offset&(1<<31) == 0 {
+			e.Offset = int64(offset)
+			continue
+		}
+		j := int(offset &^ (1 << 31))
+		if len(large) < j*8+8 {
+			return nil, errBadIndex
+		}
+		e.Offset = int64(binary.BigEndian.Uint64(large[j*8:]))
+	}
+	return idx, nil
+}
+
+func readAll(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
+
+// IndexPack indexes the packfile in r, which is size bytes long, like git
+// index-pack. All the deltas are resolved to compute the object IDs; bases
+// is used to find the ones missing from thin packs, and can be nil.
+func IndexPack(r io.ReaderAt, size int64, bases ObjectReader) (*PackIndex, error) {
+	pr, err := NewPackReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	var objects, deltas []*PackObject
+	for {
+		obj, err := pr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+	}
+
+	p := NewPack(r, nil, bases)
+	p.ids = make(map[string]int64, len(objects))
+	for _, obj := range objects {
+		if obj.ID != "" {
+			p.ids[obj.ID] = obj.Offset
+		} else {
+			deltas = append(deltas, obj)
+		}
+	}
+
+	// Ref-deltas can have as base another delta of the pack, which might
+	// not be resolved yet, so go over them until there's no progress.
+	for len(deltas) > 0 {
+		var pending []*PackObject
+		var lastErr error
+		for _, obj := range deltas {
+			t, data, err := p.ReadObjectAt(obj.Offset)
+			if _, ok := err.(MissingBaseError); ok {
+				pending = append(pending, obj)
+				lastErr = err
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			obj.ID = HashObject(t, data)
+			p.ids[obj.ID] = obj.Offset
+		}
+		if len(pending) == len(deltas) {
+			return nil, lastErr
+		}
+		deltas = pending
+	}
+
+	idx := &PackIndex{PackChecksum: pr.Checksum()}
+	for _, obj := range objects {
+		idx.Entries = append(idx.Entries, IndexEntry{ID: obj.ID, Offset: obj.Offset, CRC32: obj.CRC32})
+	}
+	sort.Sort(byID(idx.Entries))
+	return idx, nil
+}
+
+type byID []IndexEntry
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
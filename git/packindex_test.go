@@ -0,0 +1,149 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIndexPackMatchesGit(t *testing.T) {
+	for _, ofsDelta := range []bool{true, false} {
+		pack, objects := gitPack(t, ofsDelta)
+		idx, err := IndexPack(bytes.NewReader(pack), int64(len(pack)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(idx.Entries) != objects {
+			t.Fatalf("got %d entries, expected %d", len(idx.Entries), objects)
+		}
+		var buf bytes.Buffer
+		if _, err := idx.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		dir, err := ioutil.TempDir("", "gitarchive-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		packPath := filepath.Join(dir, "test.pack")
+		if err := ioutil.WriteFile(packPath, pack, 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, "index-pack", "-o", filepath.Join(dir, "test.idx"), packPath)
+		expected, err := ioutil.ReadFile(filepath.Join(dir, "test.idx"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Fatalf("ofsDelta=%v: the index differs from git index-pack's", ofsDelta)
+		}
+
+		read, err := ReadPackIndex(bytes.NewReader(expected))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(read, idx) {
+			t.Fatal("ReadPackIndex didn't read back the index")
+		}
+	}
+}
+
+// thinChain returns three packs like the ones of successive fetches, the
+// second and third thin. The third has a delta against a base that is in
+// the first, since the file "other" didn't change in the second.
+func thinChain(t *testing.T) (dir, work string, packs [][]byte) {
+	dir, work = newDeltaRepo(t)
+	content := strings.Repeat("some other line of text\n", 200)
+	for _, change := range []struct{ name, content string }{
+		{"other", content},
+		{"file", strings.Repeat("some line of text\n", 200) + "one more change\n"},
+		{"other", content + "one more change\n"},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(work, change.name), []byte(change.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, "-C", work, "add", change.name)
+		runGit(t, "-C", work, "commit", "-q", "-m", "change "+change.name)
+	}
+	packs = [][]byte{
+		packObjects(t, work, "HEAD~2\n", "--revs"),
+		packObjects(t, work, "HEAD~1\n^HEAD~2\n", "--revs", "--thin"),
+		packObjects(t, work, "HEAD\n^HEAD~1\n", "--revs", "--thin"),
+	}
+	return dir, work, packs
+}
+
+func TestIndexThinPack(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	base := packObjects(t, work, "HEAD~2\n", "--revs")
+	thin := packObjects(t, work, "HEAD\n^HEAD~2\n", "--revs", "--thin")
+
+	_, err := IndexPack(bytes.NewReader(thin), int64(len(thin)), nil)
+	if _, ok := err.(MissingBaseError); !ok {
+		t.Fatalf("expected a MissingBaseError, got %v", err)
+	}
+
+	baseIdx, err := IndexPack(bytes.NewReader(base), int64(len(base)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bases := NewPack(bytes.NewReader(base), baseIdx, nil)
+	idx, err := IndexPack(bytes.NewReader(thin), int64(len(thin)), bases)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids, expected []string
+	p := NewPack(bytes.NewReader(thin), idx, bases)
+	for _, e := range idx.Entries {
+		typ, data, err := p.ReadObject(e.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if HashObject(typ, data) != e.ID {
+			t.Fatalf("object %s has the wrong contents", e.ID)
+		}
+		ids = append(ids, e.ID)
+	}
+	for _, line := range strings.Split(runGit(t, "-C", work, "rev-list", "--objects", "HEAD", "^HEAD~2"), "\n") {
+		expected = append(expected, strings.Fields(line)[0])
+	}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("got objects %v, expected %v", ids, expected)
+	}
+
+	// In a chain of packs, the bases of thin deltas can be further down
+	// than the previous pack.
+	chainDir, _, packs := thinChain(t)
+	defer os.RemoveAll(chainDir)
+	first := indexedPack(t, packs[0], nil)
+	second := indexedPack(t, packs[1], first)
+	third := packs[2]
+	_, err = IndexPack(bytes.NewReader(third), int64(len(third)), second)
+	if _, ok := err.(MissingBaseError); !ok {
+		t.Fatalf("expected a MissingBaseError, got %v", err)
+	}
+	chain := MultiObjectReader{second, first}
+	idx, err = IndexPack(bytes.NewReader(third), int64(len(third)), chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = NewPack(bytes.NewReader(third), idx, chain)
+	for _, e := range idx.Entries {
+		typ, data, err := p.ReadObject(e.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if HashObject(typ, data) != e.ID {
+			t.Fatalf("object %s has the wrong contents", e.ID)
+		}
+	}
+}
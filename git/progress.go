@@ -0,0 +1,141 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// ProgressPhase is a step of a fetch, as reported by Options.Progress.
+type ProgressPhase string
+
+const (
+	// The server lists the objects to send, counts them, and then
+	// compresses them into deltas, before sending the packfile. Recent
+	// servers enumerate the objects instead of counting them.
+	PhaseEnumerating ProgressPhase = "Enumerating objects"
+	PhaseCounting    ProgressPhase = "Counting objects"
+	PhaseCompressing ProgressPhase = "Compressing objects"
+
+	// PhaseReceiving is the download of the packfile, which we track
+	// ourselves.
+	PhaseReceiving ProgressPhase = "Receiving"
+)
+
+// Progress is a progress update of a fetch, parsed from the messages of
+// the server on sideband channel 2.
+type Progress struct {
+	Phase ProgressPhase
+
+	// Current and Total are numbers of objects, or of bytes for
+	// PhaseReceiving. Total is 0 if unknown.
+	Current, Total int64
+
+	// Done is set on the last update of a phase.
+	Done bool
+
+	// Elapsed is the time since the phase started. The server phases are
+	// assumed to start when the previous one is done, since servers only
+	// report progress after a while.
+	Elapsed time.Duration
+}
+
+// progressRe matches the progress lines of git, like "Counting objects:
+// 42% (5/12)" or "Enumerating objects: 12, done.".
+var progressRe = regexp.MustCompile(`^(Enumerating objects|Counting objects|Compressing objects): +(?:\d+% \((\d+)/(\d+)\)|(\d+))(, done\.)?`)
+
+// progressTracker parses the sideband messages written to it, and counts
+// the packfile bytes read through reader, calling f with the updates.
+type progressTracker struct {
+	f func(Progress)
+
+	buf   []byte
+	phase ProgressPhase
+	start time.Time
+
+	// received is the number of packfile bytes, last the time of the last
+	// PhaseReceiving update.
+	received int64
+	last     time.Time
+}
+
+// receivingInterval is the time between PhaseReceiving updates.
+const receivingInterval = time.Second
+
+func newProgressTracker(f func(Progress)) *progressTracker {
+	return &progressTracker{f: f, start: time.Now()}
+}
+
+func (t *progressTracker) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	for {
+		// Updates end with \r, and the last one of a phase with \n.
+		i := bytes.IndexAny(t.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		t.parse(string(t.buf[:i]))
+		t.buf = t.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (t *progressTracker) parse(line string) {
+	m := progressRe.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	var current, total int64
+	if m[4] != "" {
+		current, _ = strconv.ParseInt(m[4], 10, 64)
+	} else {
+		current, _ = strconv.ParseInt(m[2], 10, 64)
+		total, _ = strconv.ParseInt(m[3], 10, 64)
+	}
+	t.report(ProgressPhase(m[1]), current, total, m[5] != "")
+}
+
+func (t *progressTracker) report(phase ProgressPhase, current, total int64, done bool) {
+	now := time.Now()
+	if phase != t.phase {
+		if t.phase != "" {
+			// The previous phase never said it was done.
+			t.start = now
+		}
+		t.phase = phase
+	}
+	t.f(Progress{Phase: phase, Current: current, Total: total, Done: done, Elapsed: now.Sub(t.start)})
+	if done {
+		t.phase, t.start = "", now
+	}
+}
+
+// reader returns r, reporting PhaseReceiving as the packfile is read from
+// it.
+func (t *progressTracker) reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, t: t}
+}
+
+type progressReader struct {
+	r    io.Reader
+	t    *progressTracker
+	done bool
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	t := r.t
+	t.received += int64(n)
+	if err == io.EOF {
+		if !r.done {
+			r.done = true
+			t.report(PhaseReceiving, t.received, 0, true)
+		}
+	} else if n > 0 && time.Since(t.last) >= receivingInterval {
+		t.last = time.Now()
+		t.report(PhaseReceiving, t.received, 0, false)
+	}
+	return n, err
+}
@@ -0,0 +1,78 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestProgressTracker(t *testing.T) {
+	var got []Progress
+	tr := newProgressTracker(func(p Progress) {
+		p.Elapsed = 0
+		got = append(got, p)
+	})
+	for _, msg := range []string{
+		"Enumerating objects: 12, done.\n",
+		"Counting objects:  50% (6/12)\rCounting obj",
+		"ects: 100% (12/12), done.\n",
+		"Compressing objects: 100% (3/3), done.\nTotal 12 (delta 1), reused 0 (delta 0), pack-reused 0\n",
+		"warning: something else\n",
+	} {
+		tr.Write([]byte(msg))
+	}
+	expected := []Progress{
+		{Phase: PhaseEnumerating, Current: 12, Done: true},
+		{Phase: PhaseCounting, Current: 6, Total: 12},
+		{Phase: PhaseCounting, Current: 12, Total: 12, Done: true},
+		{Phase: PhaseCompressing, Current: 3, Total: 3, Done: true},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestFetchProgress(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	runGit(t, "-C", work, "push", "-q", dir+"/repo.git", "master")
+	srv := newHTTPBackend(t, dir, false)
+	defer srv.Close()
+
+	for _, version := range []int{0, 2} {
+		var got []Progress
+		opts := &Options{ProtocolVersion: version, Progress: func(p Progress) { got = append(got, p) }}
+		res, err := FetchWithOptions(srv.URL+"/repo.git", nil, opts)
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		pack, err := ioutil.ReadAll(res.Pack)
+		res.Pack.Close()
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		stats, err := VerifyPack(bytes.NewReader(pack))
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+
+		done := make(map[ProgressPhase]Progress)
+		for _, p := range got {
+			if p.Done {
+				done[p.Phase] = p
+			}
+		}
+		if p := done[PhaseCounting]; p.Current != int64(stats.Objects) || p.Total != int64(stats.Objects) {
+			t.Errorf("v%d: got %+v, expected %d objects", version, p, stats.Objects)
+		}
+		if _, ok := done[PhaseCompressing]; !ok {
+			t.Errorf("v%d: no compression progress", version)
+		}
+		last := got[len(got)-1]
+		if last.Phase != PhaseReceiving || !last.Done || last.Current != int64(len(pack)) {
+			t.Errorf("v%d: got %+v last, expected %d bytes received", version, last, len(pack))
+		}
+	}
+}
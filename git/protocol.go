@@ -1,6 +1,7 @@
 package git
 
 import (
+	"bytes"
 	"expvar"
 	"fmt"
 	"io"
@@ -24,9 +25,84 @@ func (e RemoteError) Error() string {
 	return "remote error: " + e.Message
 }
 
-func ParseSmartResponse(body io.Reader, gitProto bool) (refs map[string]string, err error) {
+// HTTPError is returned when an HTTP server answers a request, like
+// "GET /info/refs", with an unexpected status code.
+type HTTPError struct {
+	Request    string
+	StatusCode int
+}
+
+func (e HTTPError) Error() string {
+	return e.Request + ": " + strconv.Itoa(e.StatusCode)
+}
+
+// Capabilities are the capabilities advertised by a server, in order, like
+// "ofs-delta" or "symref=HEAD:refs/heads/master".
+//
+// With protocol v2 they are the lines of the capability advertisement,
+// like "ls-refs" or "fetch=shallow filter".
+type Capabilities []string
+
+// Has reports whether the capability name was advertised, with or without
+// a value.
+func (c Capabilities) Has(name string) bool {
+	for _, cap := range c {
+		if cap == name || strings.HasPrefix(cap, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns the values of the name=value capabilities called name.
+func (c Capabilities) Values(name string) []string {
+	var res []string
+	for _, cap := range c {
+		if strings.HasPrefix(cap, name+"=") {
+			res = append(res, strings.TrimPrefix(cap, name+"="))
+		}
+	}
+	return res
+}
+
+// Advertisement is what a server tells about itself and its refs before a
+// fetch.
+type Advertisement struct {
+	// Refs maps the ref names, like "refs/heads/master" or
+	// "refs/tags/v1^{}", to object IDs.
+	Refs map[string]string
+
+	Capabilities Capabilities
+
+	// Agent is the server agent string, if any.
+	Agent string
+
+	// Symrefs maps symbolic refs to their targets, usually just
+	// "HEAD" to "refs/heads/master" or similar.
+	Symrefs map[string]string
+}
+
+func newAdvertisement(caps Capabilities) *Advertisement {
+	adv := &Advertisement{
+		Refs:         make(map[string]string),
+		Capabilities: caps,
+		Symrefs:      make(map[string]string),
+	}
+	if agents := caps.Values("agent"); len(agents) > 0 {
+		adv.Agent = agents[0]
+	}
+	for _, symref := range caps.Values("symref") {
+		parts := strings.SplitN(symref, ":", 2)
+		if len(parts) == 2 {
+			adv.Symrefs[parts[0]] = parts[1]
+		}
+	}
+	return adv
+}
+
+func ParseSmartResponse(body io.Reader, gitProto bool) (*Advertisement, error) {
 	// https://github.com/git/git/blob/master/Documentation/technical/http-protocol.txt
-	refs = make(map[string]string)
+	adv := newAdvertisement(nil)
 	state := "service-header"
 	if gitProto {
 		state = "head"
@@ -34,7 +110,7 @@ func ParseSmartResponse(body io.Reader, gitProto bool) (refs map[string]string,
 	for {
 		pktLenHex := make([]byte, 4)
 		if _, err := io.ReadFull(body, pktLenHex); err == io.EOF {
-			return refs, nil
+			return adv, nil
 		} else if err != nil {
 			return nil, err
 		}
@@ -46,7 +122,7 @@ func ParseSmartResponse(body io.Reader, gitProto bool) (refs map[string]string,
 		// "0000" marker
 		if pktLen == 0 {
 			if gitProto {
-				return refs, nil
+				return adv, nil
 			} else {
 				continue
 			}
@@ -82,9 +158,9 @@ func ParseSmartResponse(body io.Reader, gitProto bool) (refs map[string]string,
 			if len(refParts) != 2 {
 				return nil, GitParseError{state}
 			}
-			refs[refParts[1]] = refParts[0]
 
-			// caps = strings.Split(parts[1], " ")
+			adv = newAdvertisement(strings.Fields(parts[1]))
+			adv.Refs[refParts[1]] = refParts[0]
 
 			state = "ref-list"
 
@@ -93,7 +169,7 @@ func ParseSmartResponse(body io.Reader, gitProto bool) (refs map[string]string,
 			if len(refParts) != 2 {
 				return nil, GitParseError{state}
 			}
-			refs[refParts[1]] = refParts[0]
+			adv.Refs[refParts[1]] = refParts[0]
 
 		default:
 			panic("unexpected state")
@@ -107,6 +183,10 @@ type sideBandReader struct {
 
 	MsgW   io.Writer
 	Errors []byte
+
+	// StopAtFlush makes Read return io.EOF at the flush-pkt that ends the
+	// packfile section in protocol v2, where the connection stays open.
+	StopAtFlush bool
 }
 
 func (s *sideBandReader) Read(p []byte) (n int, err error) {
@@ -129,8 +209,11 @@ func (s *sideBandReader) Read(p []byte) (n int, err error) {
 			return 0, err
 		}
 
-		// "0000" marker
-		if pktLen == 0 {
+		// "0000" marker, and the other special packets
+		if pktLen == 0 && s.StopAtFlush {
+			return 0, io.EOF
+		}
+		if pktLen <= 4 {
 			continue
 		}
 
@@ -156,6 +239,34 @@ func (s *sideBandReader) Read(p []byte) (n int, err error) {
 	}
 }
 
+// writePktLine writes line to w in pkt-line format. line should include the
+// trailing LF, if any.
+func writePktLine(w *bytes.Buffer, line string) {
+	fmt.Fprintf(w, "%04x%s", len(line)+4, line)
+}
+
+// readPktLine reads a single pkt-line from r and returns its contents
+// without the trailing LF. For the special packets (flush-pkt, delim-pkt and
+// response-end-pkt) line is empty and pktLen is 0, 1 or 2 respectively.
+func readPktLine(r io.Reader) (line string, pktLen int, err error) {
+	pktLenHex := make([]byte, 4)
+	if _, err := io.ReadFull(r, pktLenHex); err != nil {
+		return "", 0, err
+	}
+	l, err := strconv.ParseUint(string(pktLenHex), 16, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	if l < 4 {
+		return "", int(l), nil
+	}
+	lineBuf := make([]byte, l-4)
+	if _, err := io.ReadFull(r, lineBuf); err != nil {
+		return "", 0, err
+	}
+	return strings.TrimSuffix(string(lineBuf), "\n"), int(l), nil
+}
+
 type countingReader struct {
 	Upstream  io.Reader
 	BytesRead int64
@@ -0,0 +1,203 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+// https://github.com/git/git/blob/master/Documentation/technical/protocol-v2.txt
+
+// detectVersion2 reads the beginning of the server response from r and
+// reports whether it is a protocol v2 capability advertisement. If it is,
+// rest is positioned right after the "version 2" line. Otherwise, rest
+// replays what was read, so it can be passed to ParseSmartResponse.
+func detectVersion2(r io.Reader) (v2 bool, rest io.Reader, err error) {
+	var buf bytes.Buffer
+	tr := io.TeeReader(r, &buf)
+	line, _, err := readPktLine(tr)
+	if err == io.EOF {
+		return false, io.MultiReader(&buf, r), nil
+	} else if err != nil {
+		return false, nil, err
+	}
+	if line == "# service=git-upload-pack" {
+		// Smart HTTP servers might or might not send the service header
+		// before a v2 advertisement. Skip it and the following flush-pkt.
+		if _, _, err := readPktLine(tr); err != nil {
+			return false, nil, err
+		}
+		line, _, err = readPktLine(tr)
+		if err == io.EOF {
+			return false, io.MultiReader(&buf, r), nil
+		} else if err != nil {
+			return false, nil, err
+		}
+	}
+	if line == "version 2" {
+		return true, r, nil
+	}
+	return false, io.MultiReader(&buf, r), nil
+}
+
+// parseCapabilitiesV2 reads a protocol v2 capability advertisement, and
+// checks that it offers the commands we need.
+func parseCapabilitiesV2(r io.Reader) (Capabilities, error) {
+	var caps Capabilities
+	for {
+		line, pktLen, err := readPktLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if pktLen == 0 {
+			break
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			return nil, RemoteError{strings.TrimPrefix(line, "ERR ")}
+		}
+		caps = append(caps, line)
+	}
+	if !caps.Has("ls-refs") {
+		return nil, GitParseError{"v2 capabilities: missing ls-refs"}
+	}
+	if !caps.Has("fetch") {
+		return nil, GitParseError{"v2 capabilities: missing fetch"}
+	}
+	return caps, nil
+}
+
+// writeCommandV2 writes the command line and the capabilities we send with
+// every command, followed by the delim-pkt that starts the arguments.
+func writeCommandV2(w *bytes.Buffer, caps Capabilities, command string) {
+	writePktLine(w, "command="+command+"\n")
+	if caps.Has("agent") {
+		writePktLine(w, "agent="+agent+"\n")
+	}
+	w.WriteString("0001")
+}
+
+func buildLsRefsRequest(caps Capabilities, prefixes []string) *bytes.Buffer {
+	req := &bytes.Buffer{}
+	writeCommandV2(req, caps, "ls-refs")
+	writePktLine(req, "peel\n")
+	writePktLine(req, "symrefs\n")
+	for _, prefix := range prefixes {
+		writePktLine(req, "ref-prefix "+prefix+"\n")
+	}
+	req.WriteString("0000")
+	return req
+}
+
+// parseLsRefs parses a ls-refs response into the same format returned by
+// ParseSmartResponse. In particular, peeled tags are stored as
+// "refs/tags/TAG^{}" entries.
+func parseLsRefs(r io.Reader, caps Capabilities) (*Advertisement, error) {
+	adv := newAdvertisement(caps)
+	for {
+		line, pktLen, err := readPktLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if pktLen == 0 {
+			return adv, nil
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			return nil, RemoteError{strings.TrimPrefix(line, "ERR ")}
+		}
+		parts := strings.Split(line, " ")
+		if len(parts) < 2 {
+			return nil, GitParseError{"ls-refs"}
+		}
+		adv.Refs[parts[1]] = parts[0]
+		for _, attr := range parts[2:] {
+			switch {
+			case strings.HasPrefix(attr, "peeled:"):
+				adv.Refs[parts[1]+"^{}"] = strings.TrimPrefix(attr, "peeled:")
+			case strings.HasPrefix(attr, "symref-target:"):
+				adv.Symrefs[parts[1]] = strings.TrimPrefix(attr, "symref-target:")
+			}
+		}
+	}
+}
+
+// buildFetchV2Request builds the fetch command of a negotiation round. The
+// haves are the common ones found so far and batch. Without done, the
+// server might answer with just the acknowledgments.
+func buildFetchV2Request(caps Capabilities, wants []string, n *negotiation, batch []string, done bool, opts *Options) (*bytes.Buffer, error) {
+	if opts.shallow() && !hasFetchFeature(caps, "shallow") {
+		return nil, UnsupportedError{"shallow"}
+	}
+	if opts.Filter != "" && !hasFetchFeature(caps, "filter") {
+		return nil, UnsupportedError{"filter"}
+	}
+	req := &bytes.Buffer{}
+	writeCommandV2(req, caps, "fetch")
+	writePktLine(req, "thin-pack\n")
+	writePktLine(req, "ofs-delta\n")
+	for _, want := range wants {
+		writePktLine(req, "want "+want+"\n")
+	}
+	writeShallow(req, opts)
+	writeFilter(req, opts)
+	n.writeHaves(req, batch, true)
+	if done {
+		writePktLine(req, "done\n")
+	}
+	req.WriteString("0000")
+	return req, nil
+}
+
+var errNoPackfile = errors.New("fetch response has no packfile section")
+
+// readFetchV2Response reads the sections of a fetch response that come
+// before the packfile, storing the shallow-info in res and the
+// acknowledgments in n. It returns false if the server only sent the
+// acknowledgments. Otherwise r is positioned at the beginning of the
+// sideband-multiplexed packfile data.
+func readFetchV2Response(r io.Reader, res *Result, n *negotiation) (pack bool, err error) {
+	for {
+		header, pktLen, err := readPktLine(r)
+		if err != nil {
+			return false, err
+		}
+		if pktLen == 0 {
+			return false, errNoPackfile
+		}
+		if strings.HasPrefix(header, "ERR ") {
+			return false, RemoteError{strings.TrimPrefix(header, "ERR ")}
+		}
+		switch header {
+		case "packfile":
+			return true, nil
+		case "shallow-info":
+			if err := readShallowInfo(r, res); err != nil {
+				return false, err
+			}
+			continue
+		case "acknowledgments":
+			pktLen, err := n.readAcksV2(r)
+			if err != nil {
+				return false, err
+			}
+			if pktLen == 0 {
+				return false, nil
+			}
+			continue
+		}
+
+		// Skip wanted-refs, packfile-uris, etc.
+		for {
+			_, pktLen, err := readPktLine(r)
+			if err != nil {
+				return false, err
+			}
+			if pktLen == 0 {
+				return false, errNoPackfile
+			}
+			if pktLen == 1 {
+				break
+			}
+		}
+	}
+}
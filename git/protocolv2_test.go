@@ -0,0 +1,69 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+var v2Advertisement = []byte("001e# service=git-upload-pack\n0000000eversion 2\n0023agent=git/github-g8f3a2d8b1b1c\n0013ls-refs=unborn\n0027fetch=shallow wait-for-done filter\n0012server-option\n0017object-format=sha1\n0000")
+
+var v2Capabilities = Capabilities{"agent=git/github-g8f3a2d8b1b1c", "ls-refs=unborn", "fetch=shallow wait-for-done filter", "server-option", "object-format=sha1"}
+
+var lsRefsResponse = []byte(`005221d7ee08fb632ae032079e10b41f5987531ba0cc HEAD symref-target:refs/heads/master
+003f21d7ee08fb632ae032079e10b41f5987531ba0cc refs/heads/master
+006c8f07421ada5140010afd7b00b313781401cd36b5 refs/tags/v1.0 peeled:21d7ee08fb632ae032079e10b41f5987531ba0cc
+0000`)
+
+var lsRefsRefs = map[string]string{"HEAD": "21d7ee08fb632ae032079e10b41f5987531ba0cc", "refs/heads/master": "21d7ee08fb632ae032079e10b41f5987531ba0cc", "refs/tags/v1.0": "8f07421ada5140010afd7b00b313781401cd36b5", "refs/tags/v1.0^{}": "21d7ee08fb632ae032079e10b41f5987531ba0cc"}
+
+func TestParseCapabilitiesV2(t *testing.T) {
+	v2, r, err := detectVersion2(bytes.NewReader(v2Advertisement))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v2 {
+		t.Fatal("v2 advertisement not detected")
+	}
+	caps, err := parseCapabilitiesV2(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(caps, v2Capabilities) {
+		t.Fatalf("Wrong caps: %v", caps)
+	}
+}
+
+func TestDetectVersion2Fallback(t *testing.T) {
+	v2, r, err := detectVersion2(bytes.NewReader(smartResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 {
+		t.Fatal("v0 advertisement detected as v2")
+	}
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, smartResponse) {
+		t.Fatal("the advertisement was not replayed")
+	}
+}
+
+func TestParseLsRefs(t *testing.T) {
+	adv, err := parseLsRefs(bytes.NewReader(lsRefsResponse), v2Capabilities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(adv.Refs, lsRefsRefs) {
+		t.Fatalf("Wrong refs: %v", adv.Refs)
+	}
+	if adv.Symrefs["HEAD"] != "refs/heads/master" {
+		t.Fatalf("Wrong symrefs: %v", adv.Symrefs)
+	}
+	if adv.Agent != "git/github-g8f3a2d8b1b1c" {
+		t.Fatalf("Wrong agent: %q", adv.Agent)
+	}
+}
@@ -0,0 +1,106 @@
+package git
+
+import "strings"
+
+// RefFilter selects refs by name with glob patterns, like "refs/heads/*" or
+// "refs/tags/v?.*". A "*" matches any run of characters, slashes included,
+// and a "?" any single character. Peeled tag entries, like
+// "refs/tags/v1^{}", are matched by the name of the tag.
+type RefFilter struct {
+	// Include are the patterns of the refs to keep. If empty, all the refs
+	// are kept.
+	Include []string
+
+	// Exclude are the patterns of the refs to drop, even if included.
+	Exclude []string
+}
+
+// DefaultRefFilter keeps everything but the pull request refs.
+var DefaultRefFilter = &RefFilter{Exclude: []string{"refs/pull/*"}}
+
+// Match reports whether the ref called name passes the filter.
+func (f *RefFilter) Match(name string) bool {
+	name = strings.TrimSuffix(name, "^{}")
+	for _, pattern := range f.Exclude {
+		if matchGlob(pattern, name) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the refs that pass the filter.
+func (f *RefFilter) Filter(refs map[string]string) map[string]string {
+	res := make(map[string]string)
+	for name, ref := range refs {
+		if f.Match(name) {
+			res[name] = ref
+		}
+	}
+	return res
+}
+
+// defaultRefPrefixes are the ref-prefix arguments of a filter without
+// Include patterns that drops the pull request refs, which are most of the
+// refs of popular repositories.
+var defaultRefPrefixes = []string{"HEAD", "refs/heads/", "refs/tags/"}
+
+// prefixes returns the protocol v2 ref-prefix arguments that cover the refs
+// the filter keeps, or nil for all refs. HEAD is always asked for, so that
+// its target is known.
+func (f *RefFilter) prefixes() []string {
+	if len(f.Include) == 0 {
+		if f.Match("refs/pull/1/head") {
+			return nil
+		}
+		return defaultRefPrefixes
+	}
+	res := []string{"HEAD"}
+	for _, pattern := range f.Include {
+		if i := strings.IndexAny(pattern, "*?"); i >= 0 {
+			pattern = pattern[:i]
+		}
+		if pattern == "" {
+			return nil
+		}
+		if pattern != "HEAD" {
+			res = append(res, pattern)
+		}
+	}
+	return res
+}
+
+// matchGlob reports whether name matches pattern, where "*" matches any run
+// of characters and "?" any single one.
+func matchGlob(pattern, name string) bool {
+	// Backtrack to the last star on mismatch, which is enough since stars
+	// match slashes too.
+	var p, n, starP, starN = 0, 0, -1, 0
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			starP, starN = p, n
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case starP >= 0:
+			starN++
+			p, n = starP+1, starN
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
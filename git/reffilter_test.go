@@ -0,0 +1,145 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRefFilterMatch(t *testing.T) {
+	headsAndTags := &RefFilter{Include: []string{"refs/heads/*", "refs/tags/*"}}
+	noNotes := &RefFilter{Exclude: []string{"refs/notes/*", "refs/pull/*"}}
+	for _, test := range []struct {
+		filter *RefFilter
+		name   string
+		match  bool
+	}{
+		{DefaultRefFilter, "HEAD", true},
+		{DefaultRefFilter, "refs/heads/master", true},
+		{DefaultRefFilter, "refs/pull/1/head", false},
+		{DefaultRefFilter, "refs/pull/1/merge", false},
+		{headsAndTags, "HEAD", false},
+		{headsAndTags, "refs/heads/feature/x", true},
+		{headsAndTags, "refs/tags/v1^{}", true},
+		{headsAndTags, "refs/notes/commits", false},
+		{noNotes, "refs/notes/commits", false},
+		{noNotes, "refs/heads/master", true},
+		{&RefFilter{Include: []string{"refs/tags/v?.*"}}, "refs/tags/v1.2", true},
+		{&RefFilter{Include: []string{"refs/tags/v?.*"}}, "refs/tags/v10.2", false},
+		{&RefFilter{Include: []string{"refs/*/master"}}, "refs/heads/master", true},
+		{&RefFilter{Include: []string{"refs/*/master"}}, "refs/heads/master2", false},
+	} {
+		if got := test.filter.Match(test.name); got != test.match {
+			t.Errorf("%+v.Match(%q) = %v", test.filter, test.name, got)
+		}
+	}
+}
+
+func TestRefFilterPrefixes(t *testing.T) {
+	f := &RefFilter{Include: []string{"HEAD", "refs/heads/*", "refs/tags/v*"}}
+	expected := []string{"HEAD", "refs/heads/", "refs/tags/v"}
+	if got := f.prefixes(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got prefixes %v", got)
+	}
+	f = &RefFilter{Include: []string{"refs/heads/master"}}
+	expected = []string{"HEAD", "refs/heads/master"}
+	if got := f.prefixes(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got prefixes %v", got)
+	}
+	if got := (&RefFilter{Include: []string{"*/master"}}).prefixes(); got != nil {
+		t.Errorf("got prefixes %v", got)
+	}
+	if got := (&RefFilter{Exclude: []string{"refs/notes/*"}}).prefixes(); got != nil {
+		t.Errorf("got prefixes %v", got)
+	}
+}
+
+// TestFetchDefaultRefPrefixes checks that the pull request refs are not
+// even listed with protocol v2.
+func TestFetchDefaultRefPrefixes(t *testing.T) {
+	dir := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	backend := newHTTPBackend(t, dir, false)
+	defer backend.Close()
+
+	var lsRefs []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && lsRefs == nil {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lsRefs = body
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		r.URL.Scheme, r.URL.Host, r.RequestURI = "http", backend.Listener.Addr().String(), ""
+		res, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		for k, v := range res.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+	}))
+	defer srv.Close()
+
+	res, err := FetchWithOptions(srv.URL+"/repo.git", nil, &Options{ProtocolVersion: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Pack != nil {
+		res.Pack.Close()
+	}
+	if !bytes.Contains(lsRefs, []byte("command=ls-refs\n")) {
+		t.Fatalf("first request isn't ls-refs: %q", lsRefs)
+	}
+	for _, prefix := range []string{"HEAD", "refs/heads/", "refs/tags/"} {
+		if !bytes.Contains(lsRefs, []byte("ref-prefix "+prefix+"\n")) {
+			t.Errorf("ls-refs lacks ref-prefix %s: %q", prefix, lsRefs)
+		}
+	}
+	if bytes.Contains(lsRefs, []byte("refs/pull/")) {
+		t.Errorf("ls-refs asks for the pull requests: %q", lsRefs)
+	}
+	head := runGit(t, "-C", filepath.Join(dir, "repo.git"), "symbolic-ref", "HEAD")
+	if res.Head() != head {
+		t.Errorf("HEAD points to %q, expected %q", res.Head(), head)
+	}
+}
+
+func TestFetchRefFilter(t *testing.T) {
+	dir := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	srv := newHTTPBackend(t, dir, false)
+	defer srv.Close()
+
+	filter := &RefFilter{Include: []string{"refs/heads/*", "refs/pull/*"}}
+	for _, version := range []int{0, 2} {
+		res, err := FetchWithOptions(srv.URL+"/repo.git", nil, &Options{ProtocolVersion: version, RefFilter: filter})
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if res.Pack != nil {
+			res.Pack.Close()
+		}
+		var names []string
+		for name := range res.Refs {
+			names = append(names, name)
+		}
+		if len(names) != 2 || res.Refs["refs/heads/master"] == "" || res.Refs["refs/pull/1/head"] == "" {
+			t.Errorf("v%d: got refs %v", version, names)
+		}
+		if res.Head() != "refs/heads/master" {
+			t.Errorf("v%d: HEAD points to %q", version, res.Head())
+		}
+	}
+}
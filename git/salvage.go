@@ -0,0 +1,211 @@
+package git
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// SalvagePack makes a packfile out of the objects that were received
+// completely at the beginning of a truncated one, read from r, which is
+// size bytes long. It writes it to w and returns the number of objects
+// kept. If there are none, nothing is written.
+//
+// Like the original one, the packfile might have deltas against objects
+// that are not in it.
+func SalvagePack(r io.ReaderAt, size int64, w io.Writer) (objects int, err error) {
+	p, err := NewPackReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return 0, nil
+	}
+	end := p.s.offset
+	for {
+		if _, err := p.Next(); err != nil {
+			break
+		}
+		if _, err := io.Copy(ioutil.Discard, p); err != nil {
+			break
+		}
+		objects++
+		end = p.s.offset
+	}
+	if objects == 0 {
+		return 0, nil
+	}
+	_, err = io.Copy(w, newPackStream(uint32(objects), io.NewSectionReader(r, 12, end-12)))
+	return objects, err
+}
+
+// commitLinks are the objects a commit points to.
+type commitLinks struct {
+	tree    string
+	parents []string
+}
+
+// completeness finds out which objects of a Pack are complete, meaning
+// that everything they point to, recursively, is either in the pack or in
+// its Bases. Objects found in the Bases are assumed to be complete.
+type completeness struct {
+	p *Pack
+
+	// blobsOK makes missing blobs acceptable, as in filtered fetches.
+	blobsOK bool
+	// shallow are the commits whose parents are not needed.
+	shallow map[string]bool
+
+	trees   map[string]bool
+	commits map[string]bool
+}
+
+// inBases reports whether id is one of the objects of the Bases of the
+// pack, which are assumed to be complete.
+func (c *completeness) inBases(id string) bool {
+	if c.p.Bases == nil {
+		return false
+	}
+	_, _, err := c.p.Bases.ReadObject(id)
+	return err == nil
+}
+
+func (c *completeness) tree(id string) (bool, error) {
+	if ok, seen := c.trees[id]; seen {
+		return ok, nil
+	}
+	if _, inPack := c.p.offsetOf(id); !inPack {
+		return c.inBases(id), nil
+	}
+	_, data, err := c.p.ReadObject(id)
+	if err != nil {
+		return false, err
+	}
+	entries, err := ParseTree(data)
+	if err != nil {
+		return false, err
+	}
+	ok := true
+	for _, e := range entries {
+		switch {
+		case e.Mode == ModeSubmodule:
+		case e.Mode == 040000:
+			ok, err = c.tree(e.ID)
+			if err != nil {
+				return false, err
+			}
+		default:
+			_, inPack := c.p.offsetOf(e.ID)
+			ok = inPack || c.blobsOK || c.inBases(e.ID)
+		}
+		if !ok {
+			break
+		}
+	}
+	c.trees[id] = ok
+	return ok, nil
+}
+
+// parseCommit returns the links of a commit object.
+func parseCommit(data []byte) commitLinks {
+	var res commitLinks
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			// End of the headers.
+			break
+		}
+		if strings.HasPrefix(line, "tree ") {
+			res.tree = strings.TrimPrefix(line, "tree ")
+		} else if strings.HasPrefix(line, "parent ") {
+			res.parents = append(res.parents, strings.TrimPrefix(line, "parent "))
+		}
+	}
+	return res
+}
+
+// CompleteCommits returns the commits of p that are complete, meaning
+// that their whole history and trees are either in p or in p.Bases, leaving
+// out those that are ancestors of others. After an interrupted fetch, these
+// are the extra haves to resume it with.
+//
+// The history stops at the shallow commits, as in a shallow fetch. If
+// blobsOK is set, as with a filtered fetch, missing blobs don't make a
+// commit incomplete.
+func CompleteCommits(p *Pack, shallow []string, blobsOK bool) ([]string, error) {
+	c := &completeness{p: p, blobsOK: blobsOK, shallow: make(map[string]bool),
+		trees: make(map[string]bool), commits: make(map[string]bool)}
+	for _, id := range shallow {
+		c.shallow[id] = true
+	}
+
+	links := make(map[string]commitLinks)
+	for _, e := range p.idx.Entries {
+		t, data, err := p.ReadObject(e.ID)
+		if err != nil {
+			return nil, err
+		}
+		if t == ObjCommit {
+			links[e.ID] = parseCommit(data)
+		}
+	}
+
+	// Go down the history iteratively, since it can be very long.
+	for id := range links {
+		stack := []string{id}
+		for len(stack) > 0 {
+			id := stack[len(stack)-1]
+			if _, done := c.commits[id]; done {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			parents := links[id].parents
+			if c.shallow[id] {
+				parents = nil
+			}
+			var pending []string
+			for _, parent := range parents {
+				if _, done := c.commits[parent]; !done {
+					if _, inPack := links[parent]; inPack {
+						pending = append(pending, parent)
+					}
+				}
+			}
+			if len(pending) > 0 {
+				stack = append(stack, pending...)
+				continue
+			}
+
+			ok, err := c.tree(links[id].tree)
+			if err != nil {
+				return nil, err
+			}
+			for _, parent := range parents {
+				if !ok {
+					break
+				}
+				if _, inPack := links[parent]; inPack {
+					ok = c.commits[parent]
+				} else {
+					ok = c.inBases(parent)
+				}
+			}
+			c.commits[id] = ok
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	ancestors := make(map[string]bool)
+	for id, ok := range c.commits {
+		if ok {
+			for _, parent := range links[id].parents {
+				ancestors[parent] = true
+			}
+		}
+	}
+	var res []string
+	for id, ok := range c.commits {
+		if ok && !ancestors[id] {
+			res = append(res, id)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
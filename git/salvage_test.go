@@ -0,0 +1,130 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// indexedPack indexes pack and returns it as a Pack.
+func indexedPack(t *testing.T, pack []byte, bases ObjectReader) *Pack {
+	idx, err := IndexPack(bytes.NewReader(pack), int64(len(pack)), bases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewPack(bytes.NewReader(pack), idx, bases)
+}
+
+func TestSalvagePack(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	full := indexedPack(t, packObjects(t, work, "", "--all"), nil)
+
+	// Write each commit right after its new blobs and trees, recording
+	// where it ends and how many objects there are up to it.
+	commits := strings.Split(runGit(t, "-C", work, "rev-list", "--reverse", "master"), "\n")
+	var body bytes.Buffer
+	var ends, counts []int
+	seen := make(map[string]bool)
+	for _, c := range commits {
+		ids := []string{runGit(t, "-C", work, "rev-parse", c+"^{tree}"), c}
+		if ls := runGit(t, "-C", work, "ls-tree", c); ls != "" {
+			ids = append([]string{strings.Fields(ls)[2]}, ids...)
+		}
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			typ, data, err := full.ReadObject(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := writePackObject(&body, typ, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ends = append(ends, 12+body.Len())
+		counts = append(counts, len(seen))
+	}
+	pack, err := ioutil.ReadAll(newPackStream(uint32(len(seen)), &body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the packfile in the blob after the fourth commit.
+	cut := pack[:ends[3]+10]
+	var salvaged bytes.Buffer
+	objects, err := SalvagePack(bytes.NewReader(cut), int64(len(cut)), &salvaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects != counts[3] {
+		t.Errorf("salvaged %d objects, expected %d", objects, counts[3])
+	}
+	p := indexedPack(t, salvaged.Bytes(), nil)
+	if tips, err := CompleteCommits(p, nil, false); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(tips, []string{commits[3]}) {
+		t.Errorf("got complete commits %v, expected %v", tips, commits[3:4])
+	}
+
+	// The next commit is only complete with the salvaged objects...
+	next := pack[ends[3]:ends[4]]
+	rest, err := ioutil.ReadAll(newPackStream(uint32(counts[4]-counts[3]), bytes.NewReader(next)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tips, err := CompleteCommits(indexedPack(t, rest, nil), nil, false); err != nil {
+		t.Fatal(err)
+	} else if len(tips) != 0 {
+		t.Errorf("got complete commits %v without the bases", tips)
+	}
+	if tips, err := CompleteCommits(indexedPack(t, rest, p), nil, false); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(tips, []string{commits[4]}) {
+		t.Errorf("got complete commits %v, expected %v", tips, commits[4:5])
+	}
+
+	// Or if it's shallow.
+	if tips, err := CompleteCommits(indexedPack(t, rest, nil), commits[4:5], false); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(tips, []string{commits[4]}) {
+		t.Errorf("got complete commits %v for a shallow commit, expected %v", tips, commits[4:5])
+	}
+
+	// Nothing is salvaged from a packfile cut in its first object.
+	salvaged.Reset()
+	if objects, err := SalvagePack(bytes.NewReader(pack[:20]), 20, &salvaged); err != nil || objects != 0 || salvaged.Len() != 0 {
+		t.Errorf("salvaged %d objects, %d bytes, %v", objects, salvaged.Len(), err)
+	}
+}
+
+func TestSalvageThinPackChain(t *testing.T) {
+	dir, work, packs := thinChain(t)
+	defer os.RemoveAll(dir)
+	first := indexedPack(t, packs[0], nil)
+	second := indexedPack(t, packs[1], first)
+
+	// The third pack is cut in its trailer, and its delta base is two
+	// packs back.
+	cut := packs[2][:len(packs[2])-10]
+	var salvaged bytes.Buffer
+	if _, err := SalvagePack(bytes.NewReader(cut), int64(len(cut)), &salvaged); err != nil {
+		t.Fatal(err)
+	}
+	_, err := IndexPack(bytes.NewReader(salvaged.Bytes()), int64(salvaged.Len()), second)
+	if _, ok := err.(MissingBaseError); !ok {
+		t.Fatalf("expected a MissingBaseError, got %v", err)
+	}
+	p := indexedPack(t, salvaged.Bytes(), MultiObjectReader{second, first})
+	head := runGit(t, "-C", work, "rev-parse", "HEAD")
+	if tips, err := CompleteCommits(p, nil, false); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(tips, []string{head}) {
+		t.Errorf("got complete commits %v, expected %v", tips, head)
+	}
+}
@@ -0,0 +1,114 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// https://github.com/git/git/blob/master/Documentation/technical/shallow.txt
+
+// UnsupportedError is returned when a fetch needs a feature the server
+// doesn't offer.
+type UnsupportedError struct {
+	Feature string
+}
+
+func (e UnsupportedError) Error() string {
+	return "the server doesn't support " + e.Feature
+}
+
+// deepen reports whether opts ask for a shallow fetch.
+func (o *Options) deepen() bool {
+	return o.Depth > 0 || !o.DeepenSince.IsZero() || len(o.DeepenNot) > 0
+}
+
+// shallow reports whether the server will send a shallow-info section.
+func (o *Options) shallow() bool {
+	return o.deepen() || len(o.Shallows) > 0
+}
+
+// shallowCapabilities returns the protocol v0 capabilities needed by the
+// shallow options.
+func shallowCapabilities(caps Capabilities, opts *Options) ([]string, error) {
+	if !opts.shallow() {
+		return nil, nil
+	}
+	if !caps.Has("shallow") {
+		return nil, UnsupportedError{"shallow"}
+	}
+	want := []string{"shallow"}
+	if !opts.DeepenSince.IsZero() {
+		if !caps.Has("deepen-since") {
+			return nil, UnsupportedError{"deepen-since"}
+		}
+		want = append(want, "deepen-since")
+	}
+	if len(opts.DeepenNot) > 0 {
+		if !caps.Has("deepen-not") {
+			return nil, UnsupportedError{"deepen-not"}
+		}
+		want = append(want, "deepen-not")
+	}
+	return want, nil
+}
+
+// hasFetchFeature reports whether the protocol v2 fetch command supports
+// feature, like "shallow" in "fetch=shallow filter".
+func hasFetchFeature(caps Capabilities, feature string) bool {
+	for _, v := range caps.Values("fetch") {
+		for _, f := range strings.Fields(v) {
+			if f == feature {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeShallow writes the shallow and deepen lines of a request. They are
+// the same in protocol v0 and v2.
+func writeShallow(w *bytes.Buffer, opts *Options) {
+	for _, s := range opts.Shallows {
+		writePktLine(w, "shallow "+s+"\n")
+	}
+	if opts.Depth > 0 {
+		writePktLine(w, fmt.Sprintf("deepen %d\n", opts.Depth))
+	}
+	if !opts.DeepenSince.IsZero() {
+		writePktLine(w, fmt.Sprintf("deepen-since %d\n", opts.DeepenSince.Unix()))
+	}
+	for _, ref := range opts.DeepenNot {
+		writePktLine(w, "deepen-not "+ref+"\n")
+	}
+}
+
+// readShallowInfo reads the shallow and unshallow lines into res, up to
+// the flush-pkt (v0) or delim-pkt (v2) that ends them.
+func readShallowInfo(r io.Reader, res *Result) error {
+	for {
+		line, pktLen, err := readPktLine(r)
+		if err != nil {
+			return err
+		}
+		if pktLen == 0 || pktLen == 1 {
+			return nil
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			return RemoteError{strings.TrimPrefix(line, "ERR ")}
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return GitParseError{"shallow-info"}
+		}
+		switch parts[0] {
+		case "shallow":
+			res.Shallow = append(res.Shallow, parts[1])
+		case "unshallow":
+			res.Unshallow = append(res.Unshallow, parts[1])
+		default:
+			return GitParseError{"shallow-info"}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/context"
+)
+
+// sshEndpoint is where an ssh URL points to.
+type sshEndpoint struct {
+	user string
+	addr string
+	path string
+}
+
+// isSCPLike reports whether gitURL is an scp-like ssh address, like
+// "git@github.com:user/repo.git". Like git, that's anything without a
+// scheme that has a colon before the first slash.
+func isSCPLike(gitURL string) bool {
+	if strings.Contains(gitURL, "://") {
+		return false
+	}
+	colon := strings.Index(gitURL, ":")
+	slash := strings.Index(gitURL, "/")
+	return colon > 0 && (slash < 0 || colon < slash)
+}
+
+// parseSSHURL parses ssh://[user@]host[:port]/path and scp-like
+// [user@]host:path addresses. The user defaults to "git".
+func parseSSHURL(gitURL string) (*sshEndpoint, error) {
+	e := &sshEndpoint{user: "git"}
+	var host, port string
+	if isSCPLike(gitURL) {
+		i := strings.Index(gitURL, ":")
+		host, e.path = gitURL[:i], gitURL[i+1:]
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			e.user, host = host[:j], host[j+1:]
+		}
+	} else {
+		u, err := url.Parse(gitURL)
+		if err != nil {
+			return nil, err
+		}
+		if u.User != nil && u.User.Username() != "" {
+			e.user = u.User.Username()
+		}
+		host, port = u.Hostname(), u.Port()
+		e.path = u.Path
+		if strings.HasPrefix(e.path, "/~") {
+			// ssh://host/~user/repo is relative to a home directory.
+			e.path = e.path[1:]
+		}
+	}
+	if host == "" || e.path == "" {
+		return nil, errors.New("invalid ssh URL " + gitURL)
+	}
+	if port == "" {
+		port = "22"
+	}
+	e.addr = net.JoinHostPort(host, port)
+	return e, nil
+}
+
+// shellQuote quotes s for a POSIX shell, like git does with the path
+// passed to git-upload-pack.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// sshConfig builds the client config from the keys and known hosts of opts.
+func sshConfig(user string, opts *Options) (*ssh.ClientConfig, error) {
+	signers := append([]ssh.Signer(nil), opts.SSHSigners...)
+	for _, name := range opts.SSHKeyFiles {
+		pem, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	hostKeyCallback := opts.HostKeyCallback
+	if hostKeyCallback == nil {
+		file := opts.KnownHostsFile
+		if file == "" {
+			file = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+		}
+		var err error
+		hostKeyCallback, err = knownhosts.New(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// sshStream is the stdin and stdout of git-upload-pack running in an ssh
+// session. Closing it closes the whole ssh connection.
+type sshStream struct {
+	io.Reader
+	io.WriteCloser
+
+	ctx     context.Context
+	session *ssh.Session
+	client  *ssh.Client
+
+	// exited is set once the output is over and the exit status received,
+	// as the error of Wait in exitErr. It could be lost once the connection
+	// is closed.
+	exited  bool
+	exitErr error
+}
+
+func (s *sshStream) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	if err == io.EOF && !s.exited {
+		s.exited, s.exitErr = true, s.session.Wait()
+	}
+	return n, ctxErr(s.ctx, err)
+}
+
+func (s *sshStream) Close() error {
+	s.session.Close()
+	return s.client.Close()
+}
+
+func fetchSSH(ctx context.Context, gitURL string, haves map[string]struct{}, opts *Options) (*Result, error) {
+	e, err := parseSSHURL(gitURL)
+	if err != nil {
+		return nil, err
+	}
+	config, err := sshConfig(e.user, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dial(ctx, "tcp", e.addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, e.addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, ctxErr(ctx, err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, ctxErr(ctx, err)
+	}
+	stream := &sshStream{ctx: ctx, session: session, client: client}
+	if stream.WriteCloser, err = session.StdinPipe(); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if stream.Reader, err = session.StdoutPipe(); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	if opts.ProtocolVersion == 2 {
+		// If the server doesn't accept the variable, we just get v0.
+		session.Setenv("GIT_PROTOCOL", "version=2")
+	}
+	if err := session.Start("git-upload-pack " + shellQuote(e.path)); err != nil {
+		stream.Close()
+		return nil, ctxErr(ctx, err)
+	}
+
+	res, err := fetchStream(stream, haves, opts)
+	if err != nil || res.Pack == nil {
+		// If git-upload-pack failed, for example because the repository
+		// doesn't exist, its output ended early with an exit status, and
+		// stderr tells why. Otherwise the fetch was just up to date, or
+		// failed on our side.
+		if err := uploadPackError(ctx, stream.exitErr, stderr.String()); err != nil {
+			return nil, err
+		}
+	}
+	return res, err
+}
@@ -0,0 +1,228 @@
+package git
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newSSHKey returns a new key, and its PEM encoding.
+func newSSHKey(t *testing.T) (ssh.Signer, []byte) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// newSSHServer serves the repositories in root over ssh to clients with
+// clientKey, running git-upload-pack like a real server would.
+func newSSHServer(t *testing.T, root string, hostKey ssh.Signer, clientKey ssh.PublicKey) (addr string, stop func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found, skipping")
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "git" || !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, ssh.ErrNoAuth
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config, root)
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig, root string) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			return
+		}
+		go serveSession(ch, reqs, root)
+	}
+}
+
+func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request, root string) {
+	defer ch.Close()
+	var env []string
+	for req := range reqs {
+		var payload struct{ Value, Extra string }
+		switch req.Type {
+		case "env":
+			ssh.Unmarshal(req.Payload, &payload)
+			if payload.Value == "GIT_PROTOCOL" {
+				env = append(env, "GIT_PROTOCOL="+payload.Extra)
+			}
+			req.Reply(true, nil)
+		case "exec":
+			ssh.Unmarshal(req.Payload, &payload)
+			path := strings.Trim(strings.TrimPrefix(payload.Value, "git-upload-pack "), "'")
+			req.Reply(true, nil)
+
+			cmd := exec.Command("git", "upload-pack", filepath.Join(root, path))
+			cmd.Env = append(os.Environ(), env...)
+			cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+			// Like sshd, don't wait for the client to close stdin once the
+			// command exited.
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				return
+			}
+			go io.Copy(stdin, ch)
+			status := make([]byte, 4)
+			if err := cmd.Run(); err != nil {
+				binary.BigEndian.PutUint32(status, 1)
+			}
+			ch.SendRequest("exit-status", false, status)
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func TestParseSSHURL(t *testing.T) {
+	for _, test := range []struct {
+		url      string
+		endpoint *sshEndpoint
+	}{
+		{"git@github.com:user/repo.git", &sshEndpoint{"git", "github.com:22", "user/repo.git"}},
+		{"example.com:repo.git", &sshEndpoint{"git", "example.com:22", "repo.git"}},
+		{"ssh://me@example.com:2222/srv/repo.git", &sshEndpoint{"me", "example.com:2222", "/srv/repo.git"}},
+		{"ssh://example.com/~me/repo.git", &sshEndpoint{"git", "example.com:22", "~me/repo.git"}},
+		{"git+ssh://[::1]/repo.git", &sshEndpoint{"git", "[::1]:22", "/repo.git"}},
+		{"ssh://example.com", nil},
+		{"./dir:with/colon", nil},
+	} {
+		e, err := parseSSHURL(test.url)
+		if test.endpoint == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.url, e)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+		} else if !reflect.DeepEqual(e, test.endpoint) {
+			t.Errorf("%s: got %+v", test.url, e)
+		}
+	}
+	if got := shellQuote("it's"); got != `'it'\''s'` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestFetchSSH(t *testing.T) {
+	dir := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	hostKey, _ := newSSHKey(t)
+	clientKey, clientPEM := newSSHKey(t)
+	addr, stop := newSSHServer(t, dir, hostKey, clientKey.PublicKey())
+	defer stop()
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey.PublicKey())
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id")
+	if err := ioutil.WriteFile(keyFile, clientPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []int{0, 2} {
+		opts := &Options{ProtocolVersion: version, SSHKeyFiles: []string{keyFile}, KnownHostsFile: knownHosts}
+		res, err := FetchWithOptions("ssh://"+addr+"/repo.git", nil, opts)
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if res.ProtocolVersion != version {
+			t.Errorf("v%d: spoke protocol v%d", version, res.ProtocolVersion)
+		}
+		if res.Refs["refs/heads/master"] == "" || res.Head() != "refs/heads/master" {
+			t.Errorf("v%d: got refs %v, HEAD %q", version, res.Refs, res.Head())
+		}
+		pack, err := ioutil.ReadAll(res.Pack)
+		res.Pack.Close()
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		checkPack(t, dir, pack)
+		os.RemoveAll(filepath.Join(dir, "check.git"))
+	}
+
+	opts := &Options{SSHSigners: []ssh.Signer{clientKey}, KnownHostsFile: knownHosts}
+	_, err := FetchWithOptions("ssh://"+addr+"/missing.git", nil, opts)
+	if _, ok := err.(RemoteError); !ok {
+		t.Errorf("missing repository: expected a RemoteError, got %v", err)
+	}
+
+	// Another host key must be refused.
+	otherKey, _ := newSSHKey(t)
+	other := knownhosts.Line([]string{knownhosts.Normalize(addr)}, otherKey.PublicKey())
+	if err := ioutil.WriteFile(knownHosts, []byte(other+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = FetchWithOptions("ssh://"+addr+"/repo.git", nil, opts)
+	if err == nil || !strings.Contains(err.Error(), "key mismatch") {
+		t.Errorf("wrong host key: got %v", err)
+	}
+
+	// And so must an unknown client key.
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unknownKey, _ := newSSHKey(t)
+	opts.SSHSigners = []ssh.Signer{unknownKey}
+	if _, err := FetchWithOptions("ssh://"+addr+"/repo.git", nil, opts); err == nil {
+		t.Error("fetched with an unknown client key")
+	}
+}
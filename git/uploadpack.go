@@ -0,0 +1,437 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// https://github.com/git/git/blob/master/Documentation/technical/pack-protocol.txt
+// (the upload-pack side)
+
+// UploadPack serves fetches of a set of refs from archived objects, like
+// git-upload-pack does from a repository. It speaks protocol v0 without
+// multi_ack, and sends packfiles without deltas.
+type UploadPack struct {
+	// Refs are the refs to advertise, like in Advertisement, including
+	// HEAD and the peeled tags.
+	Refs map[string]string
+
+	// Symrefs maps symbolic refs to their targets, usually just "HEAD" to
+	// "refs/heads/master" or similar.
+	Symrefs map[string]string
+
+	// Objects is where the objects are read from, usually a
+	// MultiObjectReader over the archived Packs.
+	Objects ObjectReader
+
+	// Shallow are the shallow boundary commits of the archived history,
+	// whose parents are missing. They are advertised, so that clones
+	// record them in .git/shallow, and the history sent stops there.
+	Shallow []string
+
+	// Filter is the filter of the fetches the objects come from, if any.
+	// Since the objects it left out are missing, only partial clones, with
+	// any filter, are served. They get all the objects there are, but
+	// can't fetch the missing ones later.
+	Filter string
+}
+
+// uploadPackCapabilities are the capabilities UploadPack advertises, along
+// with "filter" if it has a Filter, the symrefs and the agent. "shallow"
+// lets shallow clients fetch, but deepening isn't supported.
+var uploadPackCapabilities = []string{"side-band-64k", "side-band", "no-progress", "shallow"}
+
+// zeroID stands for a missing object, like in the advertisement of a
+// repository without refs.
+const zeroID = "0000000000000000000000000000000000000000"
+
+// AdvertiseRefs writes the ref advertisement, which starts the
+// conversation. With smartHTTP, it's preceded by the service header of the
+// info/refs response.
+func (u *UploadPack) AdvertiseRefs(w io.Writer, smartHTTP bool) error {
+	buf := &bytes.Buffer{}
+	if smartHTTP {
+		writePktLine(buf, "# service=git-upload-pack\n")
+		buf.WriteString("0000")
+	}
+
+	caps := append([]string{}, uploadPackCapabilities...)
+	if u.Filter != "" {
+		caps = append(caps, "filter")
+	}
+	var symrefs []string
+	for name, target := range u.Symrefs {
+		symrefs = append(symrefs, "symref="+name+":"+target)
+	}
+	sort.Strings(symrefs)
+	caps = append(caps, symrefs...)
+	caps = append(caps, "agent="+agent)
+
+	// HEAD goes first, then the refs in order, which puts peeled tags right
+	// after their tag.
+	var names []string
+	for name := range u.Refs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == "HEAD") != (names[j] == "HEAD") {
+			return names[i] == "HEAD"
+		}
+		return names[i] < names[j]
+	})
+	if len(names) == 0 {
+		writePktLine(buf, zeroID+" capabilities^{}\x00"+strings.Join(caps, " ")+"\n")
+	}
+	for i, name := range names {
+		line := u.Refs[name] + " " + name
+		if i == 0 {
+			line += "\x00" + strings.Join(caps, " ")
+		}
+		writePktLine(buf, line+"\n")
+	}
+	shallow := append([]string{}, u.Shallow...)
+	sort.Strings(shallow)
+	for _, id := range shallow {
+		writePktLine(buf, "shallow "+id+"\n")
+	}
+	buf.WriteString("0000")
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Serve reads a request from r, after the advertisement, and writes the
+// response to w. If stateless, as over smart HTTP, a request without
+// "done" gets the answer to its haves, and the client makes a new request
+// for the next round. Otherwise the negotiation goes on over r and w until
+// the packfile is sent.
+func (u *UploadPack) Serve(r io.Reader, w io.Writer, stateless bool) error {
+	wants, caps, filter, err := u.readWants(r)
+	if err == nil && len(wants) > 0 && u.Filter != "" && filter == "" {
+		err = fmt.Errorf("objects are missing, as the archive was fetched with filter %s; "+
+			"clone with --filter to get the others", u.Filter)
+	}
+	if err != nil {
+		sendPktLine(w, "ERR upload-pack: "+err.Error()+"\n")
+		return err
+	}
+	if len(wants) == 0 {
+		// The client has everything already.
+		return nil
+	}
+
+	// Without multi_ack, only the first common object is acknowledged,
+	// and a NAK ends the rounds without any.
+	var common []string
+	for {
+		line, pktLen, err := readPktLine(r)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		switch {
+		case pktLen == 0:
+			if len(common) == 0 {
+				if err := sendPktLine(w, "NAK\n"); err != nil {
+					return err
+				}
+			}
+			if stateless {
+				return nil
+			}
+		case strings.HasPrefix(line, "have "):
+			id := strings.TrimPrefix(line, "have ")
+			if !HasObject(u.Objects, id) {
+				continue
+			}
+			common = append(common, id)
+			if len(common) == 1 {
+				if err := sendPktLine(w, "ACK "+id+"\n"); err != nil {
+					return err
+				}
+			}
+		case line == "done":
+			if len(common) == 0 {
+				if err := sendPktLine(w, "NAK\n"); err != nil {
+					return err
+				}
+			}
+			return u.sendPack(w, wants, common, caps)
+		default:
+			return GitParseError{"have"}
+		}
+	}
+}
+
+// readWants reads the want lines of a request, up to the flush-pkt, and
+// returns them with the capabilities of the first one, and the filter the
+// client asked for, if any. The shallow lines of shallow clients are
+// skipped: the history they lack is sent again if needed.
+func (u *UploadPack) readWants(r io.Reader) (wants []string, caps Capabilities, filter string, err error) {
+	advertised := make(map[string]bool)
+	for _, id := range u.Refs {
+		advertised[id] = true
+	}
+	for {
+		line, pktLen, err := readPktLine(r)
+		if err == io.EOF && len(wants) == 0 {
+			// The client only wanted the advertisement.
+			return nil, nil, "", nil
+		}
+		if err != nil {
+			return nil, nil, "", unexpectedEOF(err)
+		}
+		if pktLen == 0 {
+			return wants, caps, filter, nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, nil, "", GitParseError{"want"}
+		}
+		switch fields[0] {
+		case "want":
+		case "shallow":
+			continue
+		case "filter":
+			filter = fields[1]
+			continue
+		case "deepen", "deepen-since", "deepen-not":
+			return nil, nil, "", fmt.Errorf("%s is not supported", fields[0])
+		default:
+			return nil, nil, "", GitParseError{"want"}
+		}
+		if len(wants) == 0 {
+			caps = fields[2:]
+		}
+		if !advertised[fields[1]] {
+			return nil, nil, "", fmt.Errorf("not our ref %s", fields[1])
+		}
+		wants = append(wants, fields[1])
+	}
+}
+
+// sendPack writes the packfile of the objects reachable from wants that
+// the client doesn't have, over side-band if it asked for it.
+func (u *UploadPack) sendPack(w io.Writer, wants, common []string, caps Capabilities) error {
+	var sideBand *sideBandWriter
+	if caps.Has("side-band-64k") {
+		sideBand = &sideBandWriter{w: w, band: 1, max: 65520 - 5}
+	} else if caps.Has("side-band") {
+		sideBand = &sideBandWriter{w: w, band: 1, max: 1000 - 5}
+	}
+
+	ids, err := u.objectsToSend(wants, common)
+	if err == nil {
+		if sideBand != nil {
+			bw := bufio.NewWriterSize(sideBand, sideBand.max)
+			if err = writePack(bw, u.Objects, ids); err == nil {
+				err = bw.Flush()
+			}
+		} else {
+			err = writePack(w, u.Objects, ids)
+		}
+	}
+	if sideBand == nil {
+		return err
+	}
+	if err != nil {
+		// Tell the client, if the connection is still there.
+		errW := &sideBandWriter{w: w, band: 3, max: sideBand.max}
+		errW.Write([]byte(err.Error()))
+		return err
+	}
+	_, err = io.WriteString(w, "0000")
+	return err
+}
+
+// objectsToSend returns the objects reachable from wants but not from the
+// common commits. Like git, it only leaves out the trees and blobs of the
+// common commits themselves, and not those of their ancestors. The history
+// stops at the Shallow commits, and with a Filter, the missing objects are
+// left out.
+func (u *UploadPack) objectsToSend(wants, common []string) ([]string, error) {
+	seen := make(map[string]bool)
+	if err := u.markCommon(common, seen); err != nil {
+		return nil, err
+	}
+	shallow := make(map[string]bool)
+	for _, id := range u.Shallow {
+		shallow[id] = true
+	}
+
+	var res []string
+	stack := append([]string{}, wants...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		t, data, err := u.Objects.ReadObject(id)
+		if err == ErrObjectNotFound && u.Filter != "" {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", id, err)
+		}
+		res = append(res, id)
+		if t == ObjCommit && shallow[id] {
+			stack = append(stack, parseCommit(data).tree)
+			continue
+		}
+		if t != ObjTree {
+			links, err := objectLinks(t, data, nil)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, links...)
+			continue
+		}
+		entries, err := ParseTree(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			switch {
+			case e.Mode == ModeSubmodule || seen[e.ID]:
+			case e.Mode == 040000:
+				stack = append(stack, e.ID)
+			default:
+				// Blobs are only read when writing the packfile.
+				seen[e.ID] = true
+				if u.Filter == "" || HasObject(u.Objects, e.ID) {
+					res = append(res, e.ID)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// markCommon marks in seen the history of the common commits, and their
+// trees and blobs. The history stops where objects are missing, like at
+// shallow boundaries.
+func (u *UploadPack) markCommon(common []string, seen map[string]bool) error {
+	isCommon := make(map[string]bool)
+	for _, id := range common {
+		isCommon[id] = true
+	}
+	var trees []string
+	stack := append([]string{}, common...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[id] {
+			continue
+		}
+		t, data, err := u.Objects.ReadObject(id)
+		if err == ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		seen[id] = true
+		if t != ObjCommit {
+			continue
+		}
+		c := parseCommit(data)
+		stack = append(stack, c.parents...)
+		if isCommon[id] {
+			trees = append(trees, c.tree)
+		}
+	}
+
+	for _, id := range trees {
+		if err := u.markTree(id, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *UploadPack) markTree(id string, seen map[string]bool) error {
+	if seen[id] {
+		return nil
+	}
+	seen[id] = true
+	_, data, err := u.Objects.ReadObject(id)
+	if err == ErrObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries, err := ParseTree(data)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Mode == 040000 {
+			if err := u.markTree(e.ID, seen); err != nil {
+				return err
+			}
+		} else {
+			seen[e.ID] = true
+		}
+	}
+	return nil
+}
+
+// writePack writes a packfile of the objects ids, read from objects.
+func writePack(w io.Writer, objects ObjectReader, ids []string) error {
+	h := sha1.New()
+	mw := io.MultiWriter(w, h)
+	if _, err := mw.Write(packHeader(uint32(len(ids)))); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		t, data, err := objects.ReadObject(id)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", id, err)
+		}
+		if err := writePackObject(mw, t, data); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(h.Sum(nil))
+	return err
+}
+
+// sideBandWriter writes to w in side-band packets on channel band, of up to
+// max bytes of data.
+type sideBandWriter struct {
+	w    io.Writer
+	band byte
+	max  int
+}
+
+func (s *sideBandWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > s.max {
+			chunk = chunk[:s.max]
+		}
+		hdr := append([]byte(fmt.Sprintf("%04x", len(chunk)+5)), s.band)
+		if _, err := s.w.Write(append(hdr, chunk...)); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// sendPktLine writes line to w in pkt-line format.
+func sendPktLine(w io.Writer, line string) error {
+	buf := &bytes.Buffer{}
+	writePktLine(buf, line)
+	_, err := buf.WriteTo(w)
+	return err
+}
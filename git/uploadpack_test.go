@@ -0,0 +1,280 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// archivedRepo fetches repo with opts and returns an UploadPack serving the
+// fetched refs from the fetched packfile.
+func archivedRepo(t *testing.T, repo string, opts *Options) *UploadPack {
+	res, err := FetchWithOptions(repo, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := ioutil.ReadAll(res.Pack)
+	res.Pack.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &UploadPack{Refs: res.Refs, Objects: indexedPack(t, pack, nil), Shallow: res.Shallow}
+	if opts != nil {
+		u.Filter = opts.Filter
+	}
+	if head := res.Head(); head != "" {
+		u.Symrefs = map[string]string{"HEAD": head}
+	}
+	return u
+}
+
+// uploadPackServer serves the UploadPack returned by get over smart HTTP.
+func uploadPackServer(get func() *UploadPack) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/info/refs"):
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+			get().AdvertiseRefs(w, true)
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/git-upload-pack"):
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+			get().Serve(r.Body, w, true)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// addCommit commits a new file in work and pushes it to repo.
+func addCommit(t *testing.T, work, repo, name string) {
+	if err := ioutil.WriteFile(filepath.Join(work, name), []byte(name+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, "-C", work, "add", name)
+	runGit(t, "-C", work, "commit", "-q", "-m", name)
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+}
+
+func TestUploadPackHTTP(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo.git")
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+
+	var mu sync.Mutex
+	u := archivedRepo(t, repo, nil)
+	srv := uploadPackServer(func() *UploadPack {
+		mu.Lock()
+		defer mu.Unlock()
+		return u
+	})
+	defer srv.Close()
+
+	clone := filepath.Join(dir, "clone")
+	runGit(t, "clone", "-q", srv.URL+"/repo.git", clone)
+	runGit(t, "-C", clone, "fsck", "--strict")
+	if got, expected := runGit(t, "-C", clone, "rev-parse", "HEAD"), u.Refs["HEAD"]; got != expected {
+		t.Errorf("cloned HEAD %s, expected %s", got, expected)
+	}
+	if got := runGit(t, "-C", clone, "rev-parse", "v1"); got != u.Refs["refs/tags/v1"] {
+		t.Errorf("cloned tag v1 %s, expected %s", got, u.Refs["refs/tags/v1"])
+	}
+
+	// Only the new objects are sent to a client that has the others.
+	haves := map[string]struct{}{u.Refs["HEAD"]: {}, u.Refs["refs/tags/v1"]: {}}
+	old := u.Refs["HEAD"]
+	addCommit(t, work, repo, "new")
+	mu.Lock()
+	u = archivedRepo(t, repo, nil)
+	mu.Unlock()
+
+	_, ids := fetchObjects(t, srv.URL+"/repo.git", haves)
+	if expected := revListObjects(t, repo, "master", "^"+old); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("got objects %v, expected %v", ids, expected)
+	}
+
+	runGit(t, "-C", clone, "fetch", "-q")
+	runGit(t, "-C", clone, "fsck", "--strict")
+	if got := runGit(t, "-C", clone, "rev-parse", "origin/master"); got != u.Refs["refs/heads/master"] {
+		t.Errorf("fetched master %s, expected %s", got, u.Refs["refs/heads/master"])
+	}
+}
+
+func TestUploadPackStream(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo.git")
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+	old := runGit(t, "-C", repo, "rev-parse", "master")
+	addCommit(t, work, repo, "new")
+	u := archivedRepo(t, repo, nil)
+
+	// Serve it over git://.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, _, err := readPktLine(conn); err != nil {
+					return
+				}
+				if err := u.AdvertiseRefs(conn, false); err != nil {
+					return
+				}
+				u.Serve(conn, conn, false)
+			}()
+		}
+	}()
+	gitURL := "git://" + l.Addr().String() + "/repo.git"
+
+	res, err := FetchWithOptions(gitURL, nil, &Options{ProtocolVersion: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := ioutil.ReadAll(res.Pack)
+	res.Pack.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPack(t, dir, pack)
+	if !reflect.DeepEqual(res.Refs, u.Refs) {
+		t.Errorf("got refs %v, expected %v", res.Refs, u.Refs)
+	}
+
+	_, ids := fetchObjects(t, gitURL, map[string]struct{}{old: {}, u.Refs["refs/tags/v1"]: {}})
+	if expected := revListObjects(t, repo, "master", "^"+old); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("got objects %v, expected %v", ids, expected)
+	}
+
+	// Only advertised objects can be asked for.
+	var req bytes.Buffer
+	writePktLine(&req, "want "+runGit(t, "-C", repo, "rev-parse", "master^{tree}")+"\n")
+	req.WriteString("0000")
+	var resp bytes.Buffer
+	if err := u.Serve(&req, &resp, true); err == nil {
+		t.Error("served an object that isn't a ref")
+	} else if !strings.Contains(resp.String(), "ERR upload-pack: not our ref") {
+		t.Errorf("got response %q", resp.String())
+	}
+}
+
+func TestUploadPackShallow(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo.git")
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+	u := archivedRepo(t, repo, &Options{Depth: 1})
+	if len(u.Shallow) == 0 {
+		t.Fatal("the fetch is not shallow")
+	}
+
+	srv := uploadPackServer(func() *UploadPack { return u })
+	defer srv.Close()
+	clone := filepath.Join(dir, "clone")
+	runGit(t, "clone", "-q", "--no-local", srv.URL+"/repo.git", clone)
+	runGit(t, "-C", clone, "fsck", "--strict")
+	if got := runGit(t, "-C", clone, "rev-parse", "--is-shallow-repository"); got != "true" {
+		t.Errorf("the clone is not shallow")
+	}
+	if got := runGit(t, "-C", clone, "rev-list", "--count", "HEAD"); got != "1" {
+		t.Errorf("cloned %s commits, expected 1", got)
+	}
+
+	// A shallow client can fetch again, but not deepen.
+	runGit(t, "-C", clone, "fetch", "-q")
+	cmd := exec.Command("git", "-C", clone, "fetch", "-q", "--depth=2")
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "deepen is not supported") {
+		t.Errorf("deepening: %v\n%s", err, out)
+	}
+}
+
+func TestUploadPackFilter(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo.git")
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+	runGit(t, "-C", repo, "config", "uploadpack.allowFilter", "true")
+	u := archivedRepo(t, repo, &Options{Filter: "blob:limit=100"})
+
+	srv := uploadPackServer(func() *UploadPack { return u })
+	defer srv.Close()
+	clone := filepath.Join(dir, "clone")
+	cmd := exec.Command("git", "clone", "-q", srv.URL+"/repo.git", clone)
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "blob:limit=100") {
+		t.Errorf("full clone of a filtered archive: %v\n%s", err, out)
+	}
+	os.RemoveAll(clone)
+
+	runGit(t, "clone", "-q", "--no-checkout", "--filter=blob:none", srv.URL+"/repo.git", clone)
+	runGit(t, "-C", clone, "fsck")
+	if got := runGit(t, "-C", clone, "rev-parse", "HEAD"); got != u.Refs["HEAD"] {
+		t.Errorf("cloned HEAD %s, expected %s", got, u.Refs["HEAD"])
+	}
+	// The trees are there, without the big file.
+	if got := runGit(t, "-C", clone, "ls-tree", "--name-only", "HEAD"); got != "file" {
+		t.Errorf("cloned tree %q, expected file", got)
+	}
+}
+
+func TestUploadPackChain(t *testing.T) {
+	dir, work := newDeltaRepo(t)
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo.git")
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+	first := archivedRepo(t, repo, nil)
+
+	// The second fetch is a thin pack on top of the first one, like an
+	// archived fetch and its dependency.
+	f, err := os.OpenFile(filepath.Join(work, "file"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("one more change\n")
+	f.Close()
+	runGit(t, "-C", work, "commit", "-q", "-a", "-m", "one more change")
+	runGit(t, "-C", work, "push", "-q", repo, "master")
+	haves := make(map[string]struct{})
+	for _, id := range first.Refs {
+		haves[id] = struct{}{}
+	}
+	res, err := FetchWithOptions(repo, haves, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := ioutil.ReadAll(res.Pack)
+	res.Pack.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IndexPack(bytes.NewReader(pack), int64(len(pack)), nil); err == nil {
+		t.Fatal("the second pack is not thin")
+	}
+	chain := MultiObjectReader{first.Objects}
+	chain = append(chain, indexedPack(t, pack, chain))
+	u := &UploadPack{Refs: res.Refs, Symrefs: map[string]string{"HEAD": res.Head()}, Objects: chain}
+
+	srv := uploadPackServer(func() *UploadPack { return u })
+	defer srv.Close()
+	clone := filepath.Join(dir, "clone")
+	runGit(t, "clone", "-q", srv.URL+"/repo.git", clone)
+	runGit(t, "-C", clone, "fsck", "--strict")
+	if got := runGit(t, "-C", clone, "rev-parse", "HEAD"); got != res.Refs["HEAD"] {
+		t.Errorf("cloned HEAD %s, expected %s", got, res.Refs["HEAD"])
+	}
+}
@@ -3,6 +3,8 @@ package index
 import (
 	"database/sql"
 	"encoding/json"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -14,11 +16,21 @@ type Index struct {
 
 	insertFetchQ, insertDepQ *sql.Stmt
 	selectQ, latestQ         *sql.Stmt
+	fetchAtQ, listFetchesQ   *sql.Stmt
+	listReposQ               *sql.Stmt
 
-	packrefsQ *sql.Stmt
+	packrefsQ        *sql.Stmt
+	packQ, packDepsQ *sql.Stmt
+	listPacksQ       *sql.Stmt
+	packRefCountQ    *sql.Stmt
+	listPackRefsQ    *sql.Stmt
 
 	insertBlacklistQ, selectBlacklistQ *sql.Stmt
 	updateBlacklistQ, listBlacklistQ   *sql.Stmt
+
+	setRefFilterQ, getRefFilterQ *sql.Stmt
+
+	setFailureQ, getFailureQ, clearFailureQ *sql.Stmt
 }
 
 func Open(dataSourceName string) (*Index, error) {
@@ -31,11 +43,30 @@ func Open(dataSourceName string) (*Index, error) {
 
 	query := `CREATE TABLE IF NOT EXISTS Fetches (
 		Name VARCHAR(255) NOT NULL, INDEX (Name), Parent VARCHAR(255),
-		Timestamp DATETIME, Refs JSON,
+		Timestamp DATETIME, Refs JSON, Head VARCHAR(255), Shallow JSON, Filter VARCHAR(255),
 		PackID BIGINT UNIQUE KEY AUTO_INCREMENT, PackRef VARCHAR(255))`
 	if _, err = db.Exec(query); err != nil {
 		return nil, errors.Wrap(err, "failed to create Fetches")
 	}
+	if err := addColumn(db, "Fetches", "Head", "VARCHAR(255) AFTER Refs"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "Fetches", "Shallow", "JSON AFTER Head"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "Fetches", "Filter", "VARCHAR(255) AFTER Shallow"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "Fetches", "Partial", "BOOLEAN NOT NULL DEFAULT 0 AFTER Filter"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "Fetches", "PackSize", "BIGINT AFTER PackRef"); err != nil {
+		return nil, err
+	}
+
+	if err := addIndex(db, "Fetches", "PackRef"); err != nil {
+		return nil, err
+	}
 
 	query = `CREATE TABLE IF NOT EXISTS PackDeps (ID BIGINT, INDEX (ID), Dep BIGINT)`
 	if _, err = db.Exec(query); err != nil {
@@ -49,13 +80,27 @@ func Open(dataSourceName string) (*Index, error) {
 		return nil, errors.Wrap(err, "failed to create Blacklist")
 	}
 
+	query = `CREATE TABLE IF NOT EXISTS RefFilters (
+		Name VARCHAR(255) NOT NULL UNIQUE KEY, Include JSON, Exclude JSON)`
+	if _, err = db.Exec(query); err != nil {
+		return nil, errors.Wrap(err, "failed to create RefFilters")
+	}
+
+	query = `CREATE TABLE IF NOT EXISTS Failures (
+		Name VARCHAR(255) NOT NULL UNIQUE KEY, Status VARCHAR(255), Permanent BOOLEAN NOT NULL DEFAULT 0,
+		Attempts INT NOT NULL DEFAULT 0, Error TEXT, Timestamp DATETIME)`
+	if _, err = db.Exec(query); err != nil {
+		return nil, errors.Wrap(err, "failed to create Failures")
+	}
+
 	prepStmts := []struct {
 		name **sql.Stmt
 		sql  string
 	}{
 		{
 			&i.insertFetchQ,
-			`INSERT INTO Fetches (Name, Parent, Timestamp, Refs, PackRef) VALUES (?, ?, ?, ?, ?)`,
+			`INSERT INTO Fetches (Name, Parent, Timestamp, Refs, Head, Shallow, Filter, Partial, PackRef, PackSize)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		},
 		{
 			&i.insertDepQ,
@@ -63,16 +108,49 @@ func Open(dataSourceName string) (*Index, error) {
 		},
 		{
 			&i.latestQ,
-			`SELECT Timestamp FROM Fetches WHERE Name = ? ORDER BY Timestamp DESC LIMIT 1`,
+			`SELECT Timestamp FROM Fetches WHERE Name = ? AND NOT Partial ORDER BY Timestamp DESC LIMIT 1`,
 		},
 		{
 			&i.selectQ,
-			`SELECT Parent, Refs, PackID FROM Fetches WHERE Name = ? ORDER BY Timestamp DESC LIMIT 1`,
+			`SELECT Parent, Refs, Shallow, PackID FROM Fetches WHERE Name = ? ORDER BY Timestamp DESC LIMIT 1`,
+		},
+		{
+			&i.fetchAtQ,
+			`SELECT ` + fetchColumns + ` FROM Fetches WHERE Name = ? AND Timestamp <= ? AND NOT Partial
+			ORDER BY Timestamp DESC LIMIT 1`,
+		},
+		{
+			&i.listFetchesQ,
+			`SELECT ` + fetchColumns + ` FROM Fetches WHERE Name = ? ORDER BY Timestamp`,
+		},
+		{
+			&i.listReposQ,
+			`SELECT DISTINCT Name FROM Fetches WHERE Name LIKE ? AND Name > ? ORDER BY Name LIMIT ?`,
 		},
 		{
 			&i.packrefsQ,
 			`SELECT Parent, PackRef FROM Fetches WHERE Name = ?`, // TODO fetch parents' refs too.
 		},
+		{
+			&i.packQ,
+			`SELECT PackRef FROM Fetches WHERE PackID = ?`,
+		},
+		{
+			&i.packDepsQ,
+			`SELECT Dep FROM PackDeps WHERE ID = ?`,
+		},
+		{
+			&i.listPacksQ,
+			`SELECT PackID FROM Fetches ORDER BY PackID`,
+		},
+		{
+			&i.packRefCountQ,
+			`SELECT COUNT(*) FROM Fetches WHERE PackRef = ?`,
+		},
+		{
+			&i.listPackRefsQ,
+			`SELECT DISTINCT PackRef FROM Fetches WHERE PackRef LIKE ?`,
+		},
 		{
 			&i.insertBlacklistQ,
 			`INSERT INTO Blacklist (Name, Reason) VALUES (?, ?)`,
@@ -89,6 +167,29 @@ func Open(dataSourceName string) (*Index, error) {
 			&i.listBlacklistQ,
 			`SELECT Name, Whitelisted, Reason FROM Blacklist`,
 		},
+		{
+			&i.setRefFilterQ,
+			`INSERT INTO RefFilters (Name, Include, Exclude) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE Include = VALUES(Include), Exclude = VALUES(Exclude)`,
+		},
+		{
+			&i.getRefFilterQ,
+			`SELECT Include, Exclude FROM RefFilters WHERE Name = ?`,
+		},
+		{
+			&i.setFailureQ,
+			`INSERT INTO Failures (Name, Status, Permanent, Attempts, Error, Timestamp) VALUES (?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE Status = VALUES(Status), Permanent = VALUES(Permanent),
+			Attempts = VALUES(Attempts), Error = VALUES(Error), Timestamp = VALUES(Timestamp)`,
+		},
+		{
+			&i.getFailureQ,
+			`SELECT Status, Permanent, Attempts, Error, Timestamp FROM Failures WHERE Name = ?`,
+		},
+		{
+			&i.clearFailureQ,
+			`DELETE FROM Failures WHERE Name = ?`,
+		},
 	}
 
 	for _, x := range prepStmts {
@@ -102,13 +203,78 @@ func Open(dataSourceName string) (*Index, error) {
 	return i, nil
 }
 
-func (i *Index) AddFetch(name, parent string, timestamp time.Time,
-	refs map[string]string, packRef string, packDeps []string) error {
+// addColumn adds a column to a table created by an older version, if it's
+// not there yet.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+		table, column).Scan(&n)
+	if err != nil {
+		return errors.Wrapf(err, "failed to look for %s.%s", table, column)
+	}
+	if n > 0 {
+		return nil
+	}
+	query := "ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition
+	_, err = db.Exec(query)
+	return errors.Wrapf(err, "failed to add %s.%s", table, column)
+}
+
+// addIndex adds an index on column to table, if there is none already.
+func addIndex(db *sql.DB, table, column string) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+		table, column).Scan(&n)
+	if err != nil {
+		return errors.Wrapf(err, "failed to look for an index on %s.%s", table, column)
+	}
+	if n > 0 {
+		return nil
+	}
+	query := "ALTER TABLE " + table + " ADD INDEX (" + column + ")"
+	_, err = db.Exec(query)
+	return errors.Wrapf(err, "failed to index %s.%s", table, column)
+}
+
+// AddFetch records a fetch. head is the ref HEAD pointed to, if known.
+// shallow are the shallow boundary commits of the archived history, and
+// must be nil if it's complete. filter is the git.Options.Filter of the
+// fetch, if the pack is partial. packSize is the size of the packfile.
+func (i *Index) AddFetch(name, parent string, timestamp time.Time, refs map[string]string,
+	head string, shallow []string, filter, packRef string, packSize int64, packDeps []string) error {
+	return i.addFetch(name, parent, timestamp, refs, head, shallow, filter, false, packRef, packSize, packDeps)
+}
+
+// AddPartialFetch records the objects salvaged from an interrupted fetch,
+// so that the next one can resume from them. haves are the ones of the
+// interrupted fetch along with the complete commits of packRef, and are
+// returned by GetHaves until the next fetch. Partial fetches don't count
+// for GetLatest.
+func (i *Index) AddPartialFetch(name, parent string, timestamp time.Time, haves map[string]struct{},
+	shallow []string, filter, packRef string, packSize int64, packDeps []string) error {
+	// There are no ref names, so the IDs stand for themselves.
+	refs := make(map[string]string)
+	for id := range haves {
+		refs[id] = id
+	}
+	return i.addFetch(name, parent, timestamp, refs, "", shallow, filter, true, packRef, packSize, packDeps)
+}
+
+func (i *Index) addFetch(name, parent string, timestamp time.Time, refs map[string]string, head string,
+	shallow []string, filter string, partial bool, packRef string, packSize int64, packDeps []string) error {
 	r, err := json.Marshal(refs)
 	if err != nil {
 		return err
 	}
-	res, err := i.insertFetchQ.Exec(name, parent, timestamp, r, packRef)
+	var s []byte
+	if shallow != nil {
+		if s, err = json.Marshal(shallow); err != nil {
+			return err
+		}
+	}
+	res, err := i.insertFetchQ.Exec(name, parent, timestamp, r, head, s, filter, partial, packRef, packSize)
 	if err != nil {
 		return err
 	}
@@ -134,10 +300,12 @@ func (i *Index) GetLatest(name string) (timestamp time.Time, err error) {
 	return
 }
 
-func (i *Index) GetHaves(name string) (haves map[string]struct{}, deps []string, err error) {
+// GetHaves returns the refs of the latest fetch of name and of its parent,
+// the shallow boundaries of those fetches, and the IDs of their packs.
+func (i *Index) GetHaves(name string) (haves map[string]struct{}, shallow, deps []string, err error) {
 	var parent, packID string
-	var refs []byte
-	err = i.selectQ.QueryRow(name).Scan(&parent, &refs, &packID)
+	var refs, s []byte
+	err = i.selectQ.QueryRow(name).Scan(&parent, &refs, &s, &packID)
 	if err == sql.ErrNoRows {
 		err = nil
 		return
@@ -150,6 +318,12 @@ func (i *Index) GetHaves(name string) (haves map[string]struct{}, deps []string,
 	if err != nil {
 		return
 	}
+	if s != nil {
+		err = json.Unmarshal(s, &shallow)
+		if err != nil {
+			return
+		}
+	}
 
 	haves = make(map[string]struct{})
 	for _, ref := range r {
@@ -158,7 +332,7 @@ func (i *Index) GetHaves(name string) (haves map[string]struct{}, deps []string,
 	deps = append(deps, packID)
 
 	if parent != "" {
-		err = i.selectQ.QueryRow(parent).Scan(&parent, &refs, &packID)
+		err = i.selectQ.QueryRow(parent).Scan(&parent, &refs, &s, &packID)
 		if err == sql.ErrNoRows {
 			err = nil
 			return
@@ -170,6 +344,14 @@ func (i *Index) GetHaves(name string) (haves map[string]struct{}, deps []string,
 		if err != nil {
 			return
 		}
+		if s != nil {
+			var parentShallow []string
+			err = json.Unmarshal(s, &parentShallow)
+			if err != nil {
+				return
+			}
+			shallow = append(shallow, parentShallow...)
+		}
 
 		for _, ref := range r {
 			haves[ref] = struct{}{}
@@ -180,6 +362,125 @@ func (i *Index) GetHaves(name string) (haves map[string]struct{}, deps []string,
 	return
 }
 
+// Fetch is an archived fetch of a repository.
+type Fetch struct {
+	Name, Parent string
+	Timestamp    time.Time
+
+	Refs map[string]string
+	// Head is the ref HEAD pointed to, if known.
+	Head string
+
+	// Shallow are the shallow boundary commits of the archived history, or
+	// nil if it's complete.
+	Shallow []string
+	// Filter is the filter of the latest partial fetch of Name up to this
+	// one, if any. The objects it left out may be missing from the
+	// snapshot, since the later fetches only add to it.
+	Filter string
+
+	PackID, PackRef string
+	// PackSize is the size of the packfile, or -1 if it wasn't recorded.
+	PackSize int64
+
+	// Partial is set for the objects salvaged from an interrupted fetch,
+	// whose Refs are just the haves to resume from.
+	Partial bool
+}
+
+// fetchColumns are the columns scanned by scanFetch.
+const fetchColumns = `Parent, Timestamp, Refs, Head, Shallow,
+	(SELECT p.Filter FROM Fetches AS p WHERE p.Name = Fetches.Name AND p.Timestamp <= Fetches.Timestamp
+		AND p.Filter != '' ORDER BY p.Timestamp DESC LIMIT 1),
+	PackID, PackRef, PackSize, Partial`
+
+func scanFetch(name string, row interface {
+	Scan(dest ...interface{}) error
+}) (*Fetch, error) {
+	f := &Fetch{Name: name}
+	var parent, head, filter sql.NullString
+	var size sql.NullInt64
+	var refs, shallow []byte
+	err := row.Scan(&parent, &f.Timestamp, &refs, &head, &shallow, &filter, &f.PackID, &f.PackRef, &size, &f.Partial)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(refs, &f.Refs); err != nil {
+		return nil, errors.Wrapf(err, "parsing refs of %s at %s", name, f.Timestamp)
+	}
+	if shallow != nil {
+		if err := json.Unmarshal(shallow, &f.Shallow); err != nil {
+			return nil, errors.Wrapf(err, "parsing shallow of %s at %s", name, f.Timestamp)
+		}
+	}
+	f.Parent, f.Head, f.Filter = parent.String, head.String, filter.String
+	f.PackSize = -1
+	if size.Valid {
+		f.PackSize = size.Int64
+	}
+	return f, nil
+}
+
+// GetFetchAt returns the latest complete fetch of name at or before t, or
+// nil if there is none.
+func (i *Index) GetFetchAt(name string, t time.Time) (*Fetch, error) {
+	f, err := scanFetch(name, i.fetchAtQ.QueryRow(name, t.UTC()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return f, errors.Wrapf(err, "getting fetch of %s at %s", name, t)
+}
+
+// ListFetches returns all the fetches of name, oldest first, including the
+// partial ones.
+func (i *Index) ListFetches(name string) ([]*Fetch, error) {
+	var res []*Fetch
+	rows, err := i.listFetchesQ.Query(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing fetches of %s", name)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		f, err := scanFetch(name, rows)
+		if err != nil {
+			return nil, errors.Wrapf(err, "scanning fetches of %s", name)
+		}
+		res = append(res, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "end of fetches of %s", name)
+	}
+	return res, nil
+}
+
+// likePrefix returns the LIKE pattern matching the strings starting with
+// prefix.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+}
+
+// ListRepos returns up to limit names of archived repositories starting
+// with prefix, in order, after the name after.
+func (i *Index) ListRepos(prefix, after string, limit int) ([]string, error) {
+	var res []string
+	rows, err := i.listReposQ.Query(likePrefix(prefix), after, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing repositories")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, errors.Wrap(err, "scanning repositories")
+		}
+		res = append(res, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "end of repositories listing")
+	}
+	return res, nil
+}
+
 func (i *Index) GetPackrefs(name string) (packfiles []string, err error) {
 	var parent string
 	var rows *sql.Rows
@@ -220,6 +521,78 @@ func (i *Index) GetPackrefs(name string) (packfiles []string, err error) {
 	return
 }
 
+// GetPack returns the storage name of a packfile, and the IDs of the packs
+// its thin deltas can refer to.
+func (i *Index) GetPack(packID string) (packRef string, deps []string, err error) {
+	if err := i.packQ.QueryRow(packID).Scan(&packRef); err != nil {
+		return "", nil, errors.Wrapf(err, "getting pack %s", packID)
+	}
+	rows, err := i.packDepsQ.Query(packID)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "getting deps of pack %s", packID)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dep string
+		if err := rows.Scan(&dep); err != nil {
+			return "", nil, errors.Wrapf(err, "scanning deps of pack %s", packID)
+		}
+		deps = append(deps, dep)
+	}
+	return packRef, deps, errors.Wrapf(rows.Err(), "end of deps of pack %s", packID)
+}
+
+// ListPacks returns the IDs of all the packs, oldest first.
+func (i *Index) ListPacks() ([]string, error) {
+	var res []string
+	rows, err := i.listPacksQ.Query()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing packs")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var packID string
+		if err := rows.Scan(&packID); err != nil {
+			return nil, errors.Wrap(err, "scanning packs")
+		}
+		res = append(res, packID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "end of packs listing")
+	}
+	return res, nil
+}
+
+// PackRefCount returns the number of fetches whose packfile is stored as
+// packRef, which can be shared by identical fetches.
+func (i *Index) PackRefCount(packRef string) (int, error) {
+	var n int
+	err := i.packRefCountQ.QueryRow(packRef).Scan(&n)
+	return n, errors.Wrapf(err, "counting references to %s", packRef)
+}
+
+// ListPackRefs returns the storage names of the packfiles starting with
+// prefix that are referenced by some fetch.
+func (i *Index) ListPackRefs(prefix string) (map[string]bool, error) {
+	res := make(map[string]bool)
+	rows, err := i.listPackRefsQ.Query(likePrefix(prefix))
+	if err != nil {
+		return nil, errors.Wrap(err, "listing pack refs")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var packRef string
+		if err := rows.Scan(&packRef); err != nil {
+			return nil, errors.Wrap(err, "scanning pack refs")
+		}
+		res[packRef] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "end of pack refs listing")
+	}
+	return res, nil
+}
+
 func (i *Index) AddBlacklist(name, reason string) error {
 	_, err := i.insertBlacklistQ.Exec(name, reason)
 	return errors.Wrapf(err, "adding %s to blacklist (%s)", name, reason)
@@ -233,6 +606,18 @@ const (
 	Neutral
 )
 
+func (s BlacklistState) String() string {
+	switch s {
+	case Blacklisted:
+		return "blacklisted"
+	case Whitelisted:
+		return "whitelisted"
+	case Neutral:
+		return "neutral"
+	}
+	return "BlacklistState(" + strconv.Itoa(int(s)) + ")"
+}
+
 func (i *Index) BlacklistState(name string) (BlacklistState, error) {
 	var whitelisted bool
 	err := i.selectBlacklistQ.QueryRow(name).Scan(&whitelisted)
@@ -293,6 +678,86 @@ func (i *Index) SetBlacklistState(name string, state BlacklistState) error {
 	return errors.Wrapf(err, "setting blacklist state %s %v", name, state)
 }
 
+// SetRefFilter sets the patterns of the refs to archive for name, as in
+// git.RefFilter.
+func (i *Index) SetRefFilter(name string, include, exclude []string) error {
+	inc, err := json.Marshal(include)
+	if err != nil {
+		return err
+	}
+	exc, err := json.Marshal(exclude)
+	if err != nil {
+		return err
+	}
+	_, err = i.setRefFilterQ.Exec(name, inc, exc)
+	return errors.Wrapf(err, "setting ref filter of %s", name)
+}
+
+// GetRefFilter returns the patterns set with SetRefFilter for name. ok is
+// false if there are none.
+func (i *Index) GetRefFilter(name string) (include, exclude []string, ok bool, err error) {
+	var inc, exc []byte
+	err = i.getRefFilterQ.QueryRow(name).Scan(&inc, &exc)
+	if err == sql.ErrNoRows {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, errors.Wrapf(err, "getting ref filter of %s", name)
+	}
+	if err := json.Unmarshal(inc, &include); err != nil {
+		return nil, nil, false, err
+	}
+	if err := json.Unmarshal(exc, &exclude); err != nil {
+		return nil, nil, false, err
+	}
+	return include, exclude, true, nil
+}
+
+// Failure is the latest failed fetch of a repository, since the last one
+// that succeeded.
+type Failure struct {
+	Name string
+
+	// Status is a short description of the error, like "vanished", and
+	// Error its message.
+	Status, Error string
+
+	// Permanent is set if the repository is not going to be fetched again
+	// until it's added to the queue anew.
+	Permanent bool
+
+	// Attempts is the number of fetches that failed in a row.
+	Attempts int
+
+	Timestamp time.Time
+}
+
+// SetFailure records f, replacing the previous Failure of f.Name.
+func (i *Index) SetFailure(f *Failure) error {
+	_, err := i.setFailureQ.Exec(f.Name, f.Status, f.Permanent, f.Attempts, f.Error, f.Timestamp)
+	return errors.Wrapf(err, "setting failure of %s", f.Name)
+}
+
+// GetFailure returns the Failure of name, or nil if its latest fetch
+// succeeded.
+func (i *Index) GetFailure(name string) (*Failure, error) {
+	f := &Failure{Name: name}
+	err := i.getFailureQ.QueryRow(name).Scan(&f.Status, &f.Permanent, &f.Attempts, &f.Error, &f.Timestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting failure of %s", name)
+	}
+	return f, nil
+}
+
+// ClearFailure forgets the Failure of name, after a successful fetch.
+func (i *Index) ClearFailure(name string) error {
+	_, err := i.clearFailureQ.Exec(name)
+	return errors.Wrapf(err, "clearing failure of %s", name)
+}
+
 func (i *Index) Close() error {
 	return i.db.Close()
 }
@@ -0,0 +1,480 @@
+// Package packstore gives random access to the packfiles archived by the
+// fetcher, through the .idx files stored next to them.
+package packstore
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/thecodearchive/gitarchive/blobstore"
+	"github.com/thecodearchive/gitarchive/git"
+	"github.com/thecodearchive/gitarchive/index"
+	"github.com/thecodearchive/gitarchive/lru"
+)
+
+// IndexName returns the name of the .idx of the packfile stored as packRef.
+func IndexName(packRef string) string {
+	return packRef + ".idx"
+}
+
+// PackName returns the storage name of a packfile, from its trailing
+// SHA-1 checksum, so that identical packfiles are stored once.
+func PackName(checksum string) string {
+	return packsPrefix + checksum
+}
+
+// packsPrefix starts the names of the packfiles stored by Put.
+const packsPrefix = "packs/"
+
+// IsEmpty reports whether packRef stands for a fetch without a packfile.
+func IsEmpty(packRef string) bool {
+	return strings.HasPrefix(packRef, "EMPTY|")
+}
+
+type Store struct {
+	ctx   context.Context
+	blobs blobstore.Store
+	i     *index.Index
+
+	// packs are the recently opened packs, by ID, since each holds its
+	// index and a cache of objects.
+	mu    sync.Mutex
+	packs *lru.Cache
+}
+
+// openPacks is the number of packs a Store keeps open.
+const openPacks = 32
+
+// New returns a Store reading packfiles from blobs. ctx is used for all
+// the storage operations.
+func New(ctx context.Context, blobs blobstore.Store, i *index.Index) *Store {
+	return &Store{ctx: ctx, blobs: blobs, i: i, packs: lru.New(openPacks)}
+}
+
+// Open returns the pack with ID packID, which resolves thin deltas against
+// the whole chain of its dependencies. It returns nil for empty packs.
+func (s *Store) Open(packID string) (*git.Pack, error) {
+	s.mu.Lock()
+	cached, ok := s.packs.Get(packID)
+	s.mu.Unlock()
+	if ok {
+		return cached.(*git.Pack), nil
+	}
+
+	var p *git.Pack
+	packRef, deps, err := s.i.GetPack(packID)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEmpty(packRef) {
+		idx, err := s.readIndex(packRef)
+		if err != nil {
+			return nil, err
+		}
+		// The chain is only opened as far as the deltas need.
+		p = git.NewPack(&objectReaderAt{ctx: s.ctx, blobs: s.blobs, name: packRef}, idx, s.newChain(deps))
+	}
+
+	s.mu.Lock()
+	s.packs.Add(packID, p)
+	s.mu.Unlock()
+	return p, nil
+}
+
+// Bases returns the Chain of deps, against which thin deltas are resolved:
+// their bases can be anywhere down the chain, not only in deps.
+func (s *Store) Bases(deps []string) (git.ObjectReader, error) {
+	return s.Chain(deps)
+}
+
+// Chain returns an ObjectReader over the packs packIDs and, in turn, all
+// their dependencies, read with range requests, for when few of their
+// objects are needed. The packs packIDs are opened right away, and their
+// dependencies only when an object isn't found in the packs opened so far.
+func (s *Store) Chain(packIDs []string) (git.ObjectReader, error) {
+	c := s.newChain(packIDs)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n := len(c.queue); n > 0; n-- {
+		if err := c.openNext(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// chain is a chain of packs, opened breadth-first through their
+// dependencies as far as needed to find the objects read.
+type chain struct {
+	s *Store
+
+	mu     sync.Mutex
+	packs  []*git.Pack
+	queue  []string
+	queued map[string]bool
+}
+
+func (s *Store) newChain(packIDs []string) *chain {
+	c := &chain{s: s, queued: make(map[string]bool)}
+	c.enqueue(packIDs)
+	return c
+}
+
+func (c *chain) enqueue(packIDs []string) {
+	for _, packID := range packIDs {
+		if !c.queued[packID] {
+			c.queued[packID] = true
+			c.queue = append(c.queue, packID)
+		}
+	}
+}
+
+// openNext opens the next pack of the queue, and queues its dependencies.
+// Empty packs only add their dependencies.
+func (c *chain) openNext() error {
+	packID := c.queue[0]
+	p, err := c.s.Open(packID)
+	if err != nil {
+		return err
+	}
+	_, deps, err := c.s.i.GetPack(packID)
+	if err != nil {
+		return err
+	}
+	c.queue = c.queue[1:]
+	c.enqueue(deps)
+	if p != nil {
+		c.packs = append(c.packs, p)
+	}
+	return nil
+}
+
+// find returns the pack of the chain with the object id, or nil.
+func (c *chain) find(id string) (*git.Pack, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.packs {
+		if p.HasObject(id) {
+			return p, nil
+		}
+	}
+	for len(c.queue) > 0 {
+		n := len(c.packs)
+		if err := c.openNext(); err != nil {
+			return nil, err
+		}
+		if len(c.packs) > n && c.packs[n].HasObject(id) {
+			return c.packs[n], nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *chain) ReadObject(id string) (git.ObjectType, []byte, error) {
+	p, err := c.find(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	if p == nil {
+		return 0, nil, git.ErrObjectNotFound
+	}
+	return p.ReadObject(id)
+}
+
+func (c *chain) HasObject(id string) bool {
+	p, err := c.find(id)
+	return err == nil && p != nil
+}
+
+// Local is a chain of packs read from local copies, for when many of their
+// objects are needed. Each packfile is downloaded the first time one of
+// its objects is read, but their indexes are read right away.
+type Local struct {
+	git.MultiObjectReader
+	files []*lazyFile
+}
+
+// Local returns the packs packIDs and, in turn, all their dependencies,
+// read from local copies. It must be closed to remove them.
+func (s *Store) Local(packIDs []string) (*Local, error) {
+	l := &Local{}
+	seen := make(map[string]bool)
+	queue := append([]string{}, packIDs...)
+	for len(queue) > 0 {
+		packID := queue[0]
+		queue = queue[1:]
+		if seen[packID] {
+			continue
+		}
+		seen[packID] = true
+
+		packRef, deps, err := s.i.GetPack(packID)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		queue = append(queue, deps...)
+		if IsEmpty(packRef) {
+			continue
+		}
+		idx, err := s.readIndex(packRef)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		f := &lazyFile{ctx: s.ctx, blobs: s.blobs, name: packRef}
+		l.files = append(l.files, f)
+		// Thin deltas can refer to any pack of the chain.
+		l.MultiObjectReader = append(l.MultiObjectReader, git.NewPack(f, idx, l))
+	}
+	return l, nil
+}
+
+// Close removes the local copies.
+func (l *Local) Close() error {
+	for _, f := range l.files {
+		f.close()
+	}
+	return nil
+}
+
+// lazyFile is a blob downloaded to a temporary file when it's first read.
+type lazyFile struct {
+	ctx   context.Context
+	blobs blobstore.Store
+	name  string
+
+	once sync.Once
+	f    *os.File
+	err  error
+}
+
+func (l *lazyFile) ReadAt(p []byte, off int64) (int, error) {
+	l.once.Do(l.download)
+	if l.err != nil {
+		return 0, l.err
+	}
+	return l.f.ReadAt(p, off)
+}
+
+func (l *lazyFile) download() {
+	l.f, l.err = ioutil.TempFile("", "packstore")
+	if l.err != nil {
+		return
+	}
+	r, err := blobstore.NewReader(l.ctx, l.blobs, l.name)
+	if err != nil {
+		l.err = errors.Wrapf(err, "opening %s", l.name)
+		return
+	}
+	defer r.Close()
+	_, err = io.Copy(l.f, r)
+	l.err = errors.Wrapf(err, "downloading %s", l.name)
+}
+
+func (l *lazyFile) close() {
+	if l.f != nil {
+		l.f.Close()
+		os.Remove(l.f.Name())
+	}
+}
+
+func (s *Store) readIndex(packRef string) (*git.PackIndex, error) {
+	r, err := blobstore.NewReader(s.ctx, s.blobs, IndexName(packRef))
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening index of %s", packRef)
+	}
+	defer r.Close()
+	idx, err := git.ReadPackIndex(r)
+	return idx, errors.Wrapf(err, "reading index of %s", packRef)
+}
+
+// WriteIndex indexes the packfile stored as packRef, of which r is a local
+// copy, and stores the resulting .idx next to it.
+func (s *Store) WriteIndex(packRef string, r io.ReaderAt, size int64, bases git.ObjectReader) (*git.PackIndex, error) {
+	idx, err := git.IndexPack(r, size, bases)
+	if err != nil {
+		return nil, errors.Wrapf(err, "indexing %s", packRef)
+	}
+	return idx, s.PutIndex(packRef, idx)
+}
+
+// PutIndex stores idx as the .idx of the packfile stored as packRef.
+func (s *Store) PutIndex(packRef string, idx *git.PackIndex) error {
+	w := s.blobs.NewWriter(s.ctx, IndexName(packRef))
+	if _, err := idx.WriteTo(w); err != nil {
+		w.CloseWithError(err)
+		return errors.Wrapf(err, "writing index of %s", packRef)
+	}
+	return errors.Wrapf(w.Close(), "writing index of %s", packRef)
+}
+
+// Put stores the packfile r, which is size bytes long and complete, as
+// PackName of its checksum, and returns that packRef. If a packfile
+// referenced by a fetch is stored there already, it's not uploaded again,
+// and stored is false. An unreferenced one is uploaded again so that Sweep
+// sees it as new until the fetch is recorded.
+func (s *Store) Put(r io.ReaderAt, size int64) (packRef string, stored bool, err error) {
+	if size < 20 {
+		return "", false, errors.New("packfile too short")
+	}
+	trailer := make([]byte, 20)
+	if _, err := r.ReadAt(trailer, size-20); err != nil {
+		return "", false, errors.Wrap(err, "reading packfile checksum")
+	}
+	packRef = PackName(hex.EncodeToString(trailer))
+
+	n, err := s.i.PackRefCount(packRef)
+	if err != nil {
+		return "", false, err
+	}
+	if n > 0 {
+		if _, err := s.blobs.Stat(s.ctx, packRef); err == nil {
+			return packRef, false, nil
+		}
+	}
+
+	w := s.blobs.NewWriter(s.ctx, packRef)
+	if _, err := io.Copy(w, io.NewSectionReader(r, 0, size)); err != nil {
+		w.CloseWithError(err)
+		return "", false, errors.Wrapf(err, "uploading %s", packRef)
+	}
+	return packRef, true, errors.Wrapf(w.Close(), "uploading %s", packRef)
+}
+
+// HasIndex reports whether the .idx of the packfile stored as packRef is
+// there.
+func (s *Store) HasIndex(packRef string) (bool, error) {
+	_, err := s.blobs.Stat(s.ctx, IndexName(packRef))
+	if err == blobstore.ErrNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "looking for index of %s", packRef)
+	}
+	return true, nil
+}
+
+// Sweep deletes the packfiles stored by Put that no fetch references, and
+// their .idx, if they are older than grace. The grace period covers the
+// time between Put and the recording of the fetch.
+func (s *Store) Sweep(grace time.Duration) (deleted int, err error) {
+	// List the blobs before the references, so that a pack referenced
+	// after the listing is either too new or found referenced.
+	var old []*blobstore.Attrs
+	err = s.blobs.List(s.ctx, packsPrefix, func(a *blobstore.Attrs) error {
+		if time.Since(a.Updated) > grace {
+			old = append(old, a)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "listing packfiles")
+	}
+	referenced, err := s.i.ListPackRefs(packsPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, a := range old {
+		name := a.Name
+		if referenced[strings.TrimSuffix(name, ".idx")] {
+			continue
+		}
+		// Put might have just uploaded it again.
+		a, err := s.blobs.Stat(s.ctx, name)
+		if err == blobstore.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			return deleted, errors.Wrapf(err, "checking %s", name)
+		}
+		if time.Since(a.Updated) <= grace {
+			continue
+		}
+		if err := s.blobs.Delete(s.ctx, name); err != nil && err != blobstore.ErrNotExist {
+			return deleted, errors.Wrapf(err, "deleting %s", name)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Size returns the size of the packfile stored as packRef.
+func (s *Store) Size(packRef string) (int64, error) {
+	if IsEmpty(packRef) {
+		return 0, nil
+	}
+	attrs, err := s.blobs.Stat(s.ctx, packRef)
+	if err != nil {
+		return 0, errors.Wrapf(err, "getting size of %s", packRef)
+	}
+	return attrs.Size, nil
+}
+
+// Backfill stores the .idx of the pack with ID packID, if it's missing.
+// The dependencies of the pack must have been indexed already, which is
+// the case if packs are backfilled in the order of Index.ListPacks.
+func (s *Store) Backfill(packID string) (indexed bool, err error) {
+	packRef, deps, err := s.i.GetPack(packID)
+	if err != nil || IsEmpty(packRef) {
+		return false, err
+	}
+	if ok, err := s.HasIndex(packRef); ok || err != nil {
+		return false, err
+	}
+
+	bases, err := s.Bases(deps)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := ioutil.TempFile("", "packstore")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	r, err := blobstore.NewReader(s.ctx, s.blobs, packRef)
+	if err != nil {
+		return false, errors.Wrapf(err, "opening %s", packRef)
+	}
+	size, err := io.Copy(f, r)
+	r.Close()
+	if err != nil {
+		return false, errors.Wrapf(err, "downloading %s", packRef)
+	}
+
+	if _, err := s.WriteIndex(packRef, f, size, bases); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// objectReaderAt reads a blob with range requests.
+type objectReaderAt struct {
+	ctx   context.Context
+	blobs blobstore.Store
+	name  string
+}
+
+func (r *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	rr, err := r.blobs.NewRangeReader(r.ctx, r.name, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer rr.Close()
+	n, err := io.ReadFull(rr, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -1,58 +1,116 @@
 package queue
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
-// Queue implements a simple de-duplicating queue that assumes that when a
-// consumer runs Pop it will finish its job, and that all the Add calls up to
-// the Pop call are fulfilled.
+// Queue implements a simple de-duplicating queue with at-least-once
+// delivery: Pop leases a name for a while, during which it's not popped
+// again, and the consumer then either Acks it when done, or Nacks it to have
+// it popped again. If the lease expires first, like when the consumer
+// crashed, the name is popped again. All the Add calls up to the Ack are
+// fulfilled, so an Add of a leased name makes it come back after the Ack.
 //
 // It is safe for concurrent use by multiple goroutines AND processes.
 //
-// The Queue keeps no memory of Pop-ed names, so the populator is supposed to
+// The Queue keeps no memory of Ack-ed names, so the populator is supposed to
 // know when a Pop happened more recently than the event triggering the Add.
 type Queue struct {
 	db *sql.DB
 
-	insertQ *sql.Stmt
-	selectQ *sql.Stmt
-	deleteQ *sql.Stmt
-	countQ  *sql.Stmt
+	insertQ  *sql.Stmt
+	selectQ  *sql.Stmt
+	leaseQ   *sql.Stmt
+	deleteQ  *sql.Stmt
+	releaseQ *sql.Stmt
+	extendQ  *sql.Stmt
+	countQ   *sql.Stmt
+}
+
+// ErrLeaseLost is returned by Ack, Nack and ExtendLease when the lease
+// expired, and the name might have been popped again since.
+var ErrLeaseLost = errors.New("queue: lease lost")
+
+// Lease is a name popped from the queue, which is not popped again until
+// Expiry.
+type Lease struct {
+	// ID tells this lease apart from the next ones of the same name.
+	ID string
+
+	Name, Parent string
+	Expiry       time.Time
+
+	row int64
 }
 
 func Open(dataSourceName string) (*Queue, error) {
-	db, err := sql.Open("mysql", dataSourceName)
+	// Ack, Nack and ExtendLease need the rows matched, not only changed.
+	db, err := sql.Open("mysql", dataSourceName+"?clientFoundRows=true")
 	if err != nil {
 		return nil, err
 	}
 
 	q := &Queue{db: db}
 
+	// NotBefore is the time the name becomes available, that is, the end
+	// of its lease or of the delay of AddAfter or Nack.
 	query := `CREATE TABLE IF NOT EXISTS Queue (
-		ID INTEGER PRIMARY KEY AUTO_INCREMENT, Name VARCHAR(256) UNIQUE NOT NULL, Parent VARCHAR(256))`
+		ID INTEGER PRIMARY KEY AUTO_INCREMENT, Name VARCHAR(256) UNIQUE NOT NULL, Parent VARCHAR(256),
+		NotBefore DATETIME, Lease VARCHAR(32), Readded BOOLEAN NOT NULL DEFAULT 0)`
 	if _, err = db.Exec(query); err != nil {
 		return nil, fmt.Errorf("table creation failed: %s", err)
 	}
 
-	query = `INSERT INTO Queue (Name, Parent) VALUES (?, ?) ON DUPLICATE KEY UPDATE Name=VALUES(Name)`
+	// Upgrade the queues of older versions.
+	for _, c := range []struct{ column, definition string }{
+		{"NotBefore", "DATETIME"},
+		{"Lease", "VARCHAR(32)"},
+		{"Readded", "BOOLEAN NOT NULL DEFAULT 0"},
+	} {
+		if err := addColumn(db, c.column, c.definition); err != nil {
+			return nil, err
+		}
+	}
+
+	query = `INSERT INTO Queue (Name, Parent, NotBefore) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE Readded = Readded OR Lease IS NOT NULL`
 	if q.insertQ, err = db.Prepare(query); err != nil {
 		return nil, fmt.Errorf("insert preparation failed: %s", err)
 	}
 
-	query = `SELECT ID, Name, Parent FROM Queue ORDER BY ID ASC LIMIT 1`
+	query = `SELECT ID, Name, Parent FROM Queue WHERE NotBefore IS NULL OR NotBefore <= ?
+		ORDER BY ID ASC LIMIT 1 FOR UPDATE`
 	if q.selectQ, err = db.Prepare(query); err != nil {
 		return nil, fmt.Errorf("select preparation failed: %s", err)
 	}
 
-	query = `DELETE FROM Queue WHERE ID = ?`
+	query = `UPDATE Queue SET NotBefore = ?, Lease = ? WHERE ID = ?`
+	if q.leaseQ, err = db.Prepare(query); err != nil {
+		return nil, fmt.Errorf("lease preparation failed: %s", err)
+	}
+
+	query = `DELETE FROM Queue WHERE ID = ? AND Lease = ? AND NOT Readded`
 	if q.deleteQ, err = db.Prepare(query); err != nil {
 		return nil, fmt.Errorf("delete preparation failed: %s", err)
 	}
 
+	query = `UPDATE Queue SET NotBefore = ?, Lease = NULL, Readded = 0 WHERE ID = ? AND Lease = ?`
+	if q.releaseQ, err = db.Prepare(query); err != nil {
+		return nil, fmt.Errorf("release preparation failed: %s", err)
+	}
+
+	query = `UPDATE Queue SET NotBefore = ? WHERE ID = ? AND Lease = ? AND NotBefore > ?`
+	if q.extendQ, err = db.Prepare(query); err != nil {
+		return nil, fmt.Errorf("extend preparation failed: %s", err)
+	}
+
 	query = `SELECT COUNT(*) FROM Queue`
 	if q.countQ, err = db.Prepare(query); err != nil {
 		return nil, fmt.Errorf("select preparation failed: %s", err)
@@ -61,34 +119,127 @@ func Open(dataSourceName string) (*Queue, error) {
 	return q, nil
 }
 
+// addColumn adds a column to the Queue table, if it's not there yet.
+func addColumn(db *sql.DB, column, definition string) error {
+	var n int
+	query := `SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'Queue' AND COLUMN_NAME = ?`
+	if err := db.QueryRow(query, column).Scan(&n); err != nil {
+		return fmt.Errorf("column lookup failed: %s", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	if _, err := db.Exec("ALTER TABLE Queue ADD COLUMN " + column + " " + definition); err != nil {
+		return fmt.Errorf("column creation failed: %s", err)
+	}
+	return nil
+}
+
 // Add is idempotent
 func (q *Queue) Add(name, parent string) error {
-	_, err := q.insertQ.Exec(name, parent)
+	_, err := q.insertQ.Exec(name, parent, nil)
+	return err
+}
+
+// AddAfter is like Add, but name won't be popped before t. If name is
+// already in the queue, it's left as it is.
+func (q *Queue) AddAfter(name, parent string, t time.Time) error {
+	_, err := q.insertQ.Exec(name, parent, t.Truncate(time.Second).UTC())
 	return err
 }
 
-// Pop returns "", "", nil when the queue is empty
-func (q *Queue) Pop() (name, parent string, err error) {
+// Pop leases the oldest available name for d. It returns nil, nil when the
+// queue is empty, or when nothing in it is available yet.
+func (q *Queue) Pop(d time.Duration) (*Lease, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	l := &Lease{ID: hex.EncodeToString(id)}
+
 	tx, err := q.db.Begin()
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
-	defer func() { err = tx.Commit() }()
-
-	var id int
-	err = tx.Stmt(q.selectQ).QueryRow().Scan(&id, &name, &parent)
+	now := time.Now()
+	err = tx.Stmt(q.selectQ).QueryRow(now.UTC()).Scan(&l.row, &l.Name, &l.Parent)
 	if err == sql.ErrNoRows {
-		return "", "", nil
+		return nil, tx.Commit()
 	} else if err != nil {
-		return "", "", err
+		tx.Rollback()
+		return nil, err
 	}
 
-	_, err = tx.Stmt(q.deleteQ).Exec(id)
+	// DATETIME has a precision of a second, and MySQL rounds to it, so
+	// round down to be safe.
+	l.Expiry = now.Add(d).Truncate(time.Second)
+	if _, err := tx.Stmt(q.leaseQ).Exec(l.Expiry.UTC(), l.ID, l.row); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Ack removes the name of l from the queue, unless it was added again
+// since the Pop, in which case it's available right away.
+func (q *Queue) Ack(l *Lease) error {
+	res, err := q.deleteQ.Exec(l.row, l.ID)
 	if err != nil {
-		return "", "", err
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return err
 	}
+	return q.release(l, time.Time{})
+}
 
-	return
+// Nack gives up the lease l, and makes its name available again after
+// delay.
+func (q *Queue) Nack(l *Lease, delay time.Duration) error {
+	return q.release(l, time.Now().Add(delay))
+}
+
+func (q *Queue) release(l *Lease, notBefore time.Time) error {
+	var nb interface{}
+	if !notBefore.IsZero() {
+		nb = notBefore.Truncate(time.Second).UTC()
+	}
+	res, err := q.releaseQ.Exec(nb, l.row, l.ID)
+	if err != nil {
+		return err
+	}
+	return checkLease(res)
+}
+
+// ExtendLease makes l expire d from now, if it didn't already.
+func (q *Queue) ExtendLease(l *Lease, d time.Duration) error {
+	now := time.Now()
+	expiry := now.Add(d).Truncate(time.Second)
+	res, err := q.extendQ.Exec(expiry.UTC(), l.row, l.ID, now.UTC())
+	if err != nil {
+		return err
+	}
+	if err := checkLease(res); err != nil {
+		return err
+	}
+	l.Expiry = expiry
+	return nil
+}
+
+// checkLease returns ErrLeaseLost if res didn't affect the leased row.
+func checkLease(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
 }
 
 func (q *Queue) Len() (int, error) {
@@ -21,6 +21,17 @@ func checkNAndP(t *testing.T, wantN, wantP, n, p string) {
 	}
 }
 
+// popAck pops a name and acks it right away.
+func popAck(t *testing.T, q *Queue) (n, p string) {
+	l, err := q.Pop(time.Minute)
+	fatalIfErr(t, err)
+	if l == nil {
+		return "", ""
+	}
+	fatalIfErr(t, q.Ack(l))
+	return l.Name, l.Parent
+}
+
 func TestQueueMySQL(t *testing.T) {
 	if os.Getenv("TEST_MYSQL_DSN") == "" {
 		t.Skip("TEST_MYSQL_DSN missing, skipping MySQL test")
@@ -31,14 +42,12 @@ func TestQueueMySQL(t *testing.T) {
 }
 
 func testQueue(t *testing.T, q *Queue) {
-	n, p, err := q.Pop()
-	fatalIfErr(t, err)
+	n, p := popAck(t, q)
 	checkNAndP(t, "", "", n, p)
 	fatalIfErr(t, q.Add("a", ""))
 	fatalIfErr(t, q.Add("b", "b"))
 	fatalIfErr(t, q.Add("a", ""))
-	n, p, err = q.Pop()
-	fatalIfErr(t, err)
+	n, p = popAck(t, q)
 	checkNAndP(t, "a", "", n, p)
 	fatalIfErr(t, q.Add("c", "c"))
 	len, err := q.Len()
@@ -46,24 +55,68 @@ func testQueue(t *testing.T, q *Queue) {
 	if len != 2 {
 		t.Errorf("wrong length %d, expected 2", len)
 	}
-	n, p, err = q.Pop()
-	fatalIfErr(t, err)
+	n, p = popAck(t, q)
 	checkNAndP(t, "b", "b", n, p)
-	n, p, err = q.Pop()
-	fatalIfErr(t, err)
+	n, p = popAck(t, q)
 	checkNAndP(t, "c", "c", n, p)
-	n, p, err = q.Pop()
-	fatalIfErr(t, err)
+	n, p = popAck(t, q)
+	checkNAndP(t, "", "", n, p)
+	fatalIfErr(t, q.AddAfter("d", "", time.Now().Add(2*time.Second)))
+	n, p = popAck(t, q)
 	checkNAndP(t, "", "", n, p)
+	time.Sleep(3 * time.Second)
+	n, p = popAck(t, q)
+	checkNAndP(t, "d", "", n, p)
+	testLeases(t, q)
 	fatalIfErr(t, q.Close())
 }
 
+func testLeases(t *testing.T, q *Queue) {
+	fatalIfErr(t, q.Add("e", "p"))
+	l, err := q.Pop(time.Minute)
+	fatalIfErr(t, err)
+	checkNAndP(t, "e", "p", l.Name, l.Parent)
+	if n, p := popAck(t, q); n != "" {
+		t.Fatalf("Popped leased %s %s", n, p)
+	}
+	fatalIfErr(t, q.ExtendLease(l, 2*time.Minute))
+
+	// Added again while leased, it comes back after the Ack.
+	fatalIfErr(t, q.Add("e", "p"))
+	fatalIfErr(t, q.Ack(l))
+	l, err = q.Pop(time.Minute)
+	fatalIfErr(t, err)
+	checkNAndP(t, "e", "p", l.Name, l.Parent)
+
+	// Nacked, the lease is over.
+	fatalIfErr(t, q.Nack(l, 0))
+	if err := q.Ack(l); err != ErrLeaseLost {
+		t.Fatalf("Ack after Nack: %v", err)
+	}
+
+	// Expired, it comes back, and the old lease is lost.
+	l, err = q.Pop(time.Second)
+	fatalIfErr(t, err)
+	checkNAndP(t, "e", "p", l.Name, l.Parent)
+	time.Sleep(2 * time.Second)
+	l2, err := q.Pop(time.Minute)
+	fatalIfErr(t, err)
+	checkNAndP(t, "e", "p", l2.Name, l2.Parent)
+	if err := q.ExtendLease(l, time.Minute); err != ErrLeaseLost {
+		t.Fatalf("ExtendLease of an expired lease: %v", err)
+	}
+	if err := q.Ack(l); err != ErrLeaseLost {
+		t.Fatalf("Ack of an expired lease: %v", err)
+	}
+	fatalIfErr(t, q.Ack(l2))
+	n, p := popAck(t, q)
+	checkNAndP(t, "", "", n, p)
+}
+
 func waitForValue(t *testing.T, q *Queue, wantN, wantP string) {
 	var n, p string
-	var err error
 	for i := 0; i < 500; i++ {
-		n, p, err = q.Pop()
-		fatalIfErr(t, err)
+		n, p = popAck(t, q)
 		if n == wantN && p == wantP {
 			return
 		}
@@ -87,8 +140,7 @@ func TestQueueConcurrency(t *testing.T) {
 	q, err := Open("sqlite3", "./test_concurr.db")
 	fatalIfErr(t, err)
 
-	n, p, err := q.Pop()
-	fatalIfErr(t, err)
+	n, p := popAck(t, q)
 	checkNAndP(t, "", "", n, p)
 
 	cmd := exec.Command(os.Args[0], "-test.run=^TestQueueConcurrency$")